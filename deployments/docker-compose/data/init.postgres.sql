@@ -15,12 +15,76 @@ CREATE TABLE "users" (
   "phone"         text,
   "user_type"     text,
   "user_id"       text,
-  "token"         text,
-  "refresh_token" text,
   "totp_enabled"  boolean,
   "totp"          text,
   "options"       text,
   "public_key"    text,
   PRIMARY KEY ("id")
-)
+);
 
+CREATE TABLE "refresh_tokens" (
+  "id"          bigserial,
+  "created_at"  timestamptz,
+  "updated_at"  timestamptz,
+  "token_id"    text,
+  "family_id"   text,
+  "user_id"     text,
+  "expires_at"  timestamptz,
+  "used"        boolean DEFAULT false,
+  "revoked"     boolean DEFAULT false,
+  PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX "idx_refresh_tokens_token_id" ON "refresh_tokens" ("token_id");
+CREATE INDEX "idx_refresh_tokens_family_id" ON "refresh_tokens" ("family_id");
+CREATE INDEX "idx_refresh_tokens_user_id" ON "refresh_tokens" ("user_id");
+
+CREATE TABLE "revoked_tokens" (
+  "id"          bigserial,
+  "created_at"  timestamptz,
+  "token_id"    text,
+  "user_id"     text,
+  "expires_at"  timestamptz,
+  PRIMARY KEY ("id")
+);
+
+CREATE INDEX "idx_revoked_tokens_token_id" ON "revoked_tokens" ("token_id");
+CREATE INDEX "idx_revoked_tokens_user_id" ON "revoked_tokens" ("user_id");
+
+CREATE TABLE "sessions" (
+  "id"            bigserial,
+  "created_at"    timestamptz,
+  "updated_at"    timestamptz,
+  "session_id"    text,
+  "user_id"       text,
+  "user_agent"    text,
+  "ip_address"    text,
+  "last_used_at"  timestamptz,
+  "idle_timeout"  bigint,
+  "expires_at"    timestamptz,
+  "client_id"     text,
+  "nonce"         text,
+  PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX "idx_sessions_session_id" ON "sessions" ("session_id");
+CREATE INDEX "idx_sessions_user_id" ON "sessions" ("user_id");
+
+CREATE TABLE "authorization_codes" (
+  "id"              bigserial,
+  "created_at"      timestamptz,
+  "updated_at"      timestamptz,
+  "code_hash"       text,
+  "client_id"       text,
+  "user_id"         text,
+  "redirect_uri"    text,
+  "scope"           text,
+  "nonce"           text,
+  "code_challenge"  text,
+  "expires_at"      timestamptz,
+  "used"            boolean,
+  PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX "idx_authorization_codes_code_hash" ON "authorization_codes" ("code_hash");
+CREATE INDEX "idx_authorization_codes_user_id" ON "authorization_codes" ("user_id");
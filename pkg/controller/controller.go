@@ -11,8 +11,11 @@ import (
 	"time"
 
 	"github.com/crossedbot/common/golang/config"
+	"github.com/crossedbot/simplejwt"
+	"github.com/crossedbot/simplejwt/algorithms"
 	"github.com/crossedbot/simplejwt/jwk"
 	middleware "github.com/crossedbot/simplemiddleware"
+	"github.com/google/uuid"
 	"github.com/sec51/twofactor"
 
 	"github.com/crossedbot/simpleauth/pkg/database"
@@ -28,6 +31,9 @@ const (
 	DefaultCertificate     = "~/.simpleauth/simpleauth.cert"
 	DefaultDatabasePath    = "postgresql://postgres@127.0.0.1:5432/auth"
 	DefaultDatabaseDialect = database.DialectPostgres
+	DefaultSessionIdle     = RefreshTokenExpiration
+	DefaultSessionLifetime = 30 * 24 * time.Hour
+	DefaultTokenIssuer     = "http://127.0.0.1:8080"
 )
 
 var (
@@ -40,23 +46,102 @@ var (
 	ErrorPublicKeyRequired = errors.New("Public key is required")
 	ErrorTotpNotFound      = errors.New("TOTP not set for user")
 	ErrorPublicKeyNotFound = errors.New("A public key is not set for this user")
+	ErrorRefreshRequired   = errors.New("A refresh token is required")
+	ErrorRefreshInvalid    = errors.New("The refresh token is invalid")
+	ErrorRefreshReused     = errors.New("The refresh token has already been used; its session has been revoked")
+	ErrorTokenRevoked      = errors.New("The token has been revoked")
+	ErrorSessionNotFound   = errors.New("Session not found")
+	ErrorSessionExpired    = errors.New("The session has expired")
+	ErrorClientInvalid     = errors.New("Client authentication failed")
+	ErrorRedirectInvalid   = errors.New("The redirect URI is not registered for the client")
+	ErrorOtpRequired       = errors.New("A one-time password is required")
+	ErrorOtpInvalid        = errors.New("The one-time password is incorrect")
+
+	// OAuth errors
+	ErrorOAuthClient = models.OAuthError{
+		Code:        models.OAuthErrorInvalidClient,
+		Description: "Client authentication failed",
+	}
+	ErrorOAuthGrant = models.OAuthError{
+		Code:        models.OAuthErrorInvalidGrant,
+		Description: "The grant is invalid, expired or already used",
+	}
+	ErrorOAuthGrantType = models.OAuthError{
+		Code:        models.OAuthErrorUnsupportedGrantType,
+		Description: "The grant type is not supported",
+	}
+	ErrorOAuthResponseType = models.OAuthError{
+		Code:        models.OAuthErrorUnsupportedResponseType,
+		Description: "Only the code response type is supported",
+	}
+	ErrorOAuthCodeChallenge = models.OAuthError{
+		Code:        models.OAuthErrorInvalidRequest,
+		Description: "A S256 code challenge is required",
+	}
+	ErrorOAuthUnauthorizedClient = models.OAuthError{
+		Code:        models.OAuthErrorUnauthorizedClient,
+		Description: "The client is not authorized to use this grant type",
+	}
+	ErrorOAuthScope = models.OAuthError{
+		Code:        models.OAuthErrorInvalidScope,
+		Description: "The scope exceeds the grants of the client",
+	}
 )
 
 // Controller represents an interface to an authentication service.
 type Controller interface {
+	// AuthenticateClient returns the registered OAuth client for the given
+	// client ID and secret. If the client is unknown or the secret does not
+	// match, ErrorClientInvalid is returned.
+	AuthenticateClient(clientId, secret string) (models.Client, error)
+
+	// AuthorizeCode returns a new authorization code for the given
+	// authorization request, once the user of the given login and OTP has
+	// authenticated. The OTP is only required if the user has TOTP enabled.
+	AuthorizeCode(req models.AuthorizationRequest, login models.Login, otp string) (string, error)
+
+	// DeleteSession ends the session for the given session ID of the given
+	// user ID.
+	DeleteSession(id, sessionId string) error
+
 	// GetJwks returns the JSON web key of the authentication service.
 	GetJwks() (jwk.Jwks, error)
 
+	// GetOpenIdConfiguration returns the OpenID Connect discovery document of
+	// the authentication service.
+	GetOpenIdConfiguration() models.OpenIdConfiguration
+
 	// GetOtpQr returns an image of the QR code for the given user ID.
 	GetOtpQr(id string) ([]byte, error)
 
-	// Login returns a new AccessToken for the given login request.
-	// Effectively, logging in the user for as long the token remains valid.
-	Login(login models.Login) (models.AccessToken, error)
+	// GetSessions returns the active sessions of the given user ID.
+	GetSessions(id string) ([]models.Session, error)
+
+	// GetUserInfo returns the OpenID Connect claims of the given user ID.
+	GetUserInfo(id string) (models.UserInfo, error)
+
+	// Introspect returns the state of the given access or refresh token.
+	// Tokens that fail validation, were revoked or belong to an ended session
+	// are reported as inactive.
+	Introspect(tkn string) (models.Introspection, error)
+
+	// Login returns a new AccessToken for the given login request and the
+	// device logging in. Effectively, logging in the user for as long the
+	// token remains valid. If the login is on behalf of an OAuth client, the
+	// client must be registered.
+	Login(login models.Login, device models.Device) (models.AccessToken, error)
 
 	// LoginWithPublicKey returns a new AccessToken for the given public key
-	// authentication request.
-	LoginWithPublicKey(pubKey models.SignedPublicKey) (models.AccessToken, error)
+	// authentication request and the device logging in.
+	LoginWithPublicKey(pubKey models.SignedPublicKey, device models.Device) (models.AccessToken, error)
+
+	// Logout revokes the given access token, along with the refresh tokens
+	// of its family. Effectively, ending the token's session.
+	Logout(tkn string) error
+
+	// LogoutAll revokes every access and refresh token issued to the given
+	// user ID. Effectively, ending all of the user's sessions.
+	LogoutAll(id string) error
 
 	// RegisterPublicKey registers the public authentication key for the given
 	// user.
@@ -70,10 +155,23 @@ type Controller interface {
 	// tokens.
 	SetAuthPrivateKey(privKey io.Reader) error
 
+	// SetClients sets the OAuth clients registered with the authentication
+	// service. An error is returned if a client's grants are unknown.
+	SetClients(clients []models.Client) error
+
 	// SetDatabase sets the user database for the authentication service at
 	// the given address.
 	SetDatabase(dialect, path string) error
 
+	// SetSessionLifetimes sets how long a session may be idle for, and how
+	// long a session may last in total.
+	SetSessionLifetimes(idle, lifetime time.Duration)
+
+	// SetTokenIssuer sets the issuer of the authentication service's
+	// tokens. The issuer is expected to be the URL the service is reachable
+	// at.
+	SetTokenIssuer(issuer string)
+
 	// SetTotp sets the TOTP for the given user ID. Implementations, should
 	// only enable/disable TOTP for the given user.
 	SetTotp(id string, totp models.Totp) (models.Totp, error)
@@ -82,26 +180,51 @@ type Controller interface {
 	SetTotpIssuer(issuer string)
 
 	// SignUp adds the given user to the authentication service and returns
-	// a new Accesstoken.
-	SignUp(user models.User) (models.AccessToken, error)
+	// a new Accesstoken for the device signing up.
+	SignUp(user models.User, device models.Device) (models.AccessToken, error)
 
-	// RefreshToken returns a new AccessToken for the given user ID.
-	// Effectively, refreshing the authenticated access.
-	RefreshToken(id string) (models.AccessToken, error)
+	// Token returns a new AccessToken for the given OAuth token request, and
+	// the device making the request. Errors concerning the request itself are
+	// returned as a models.OAuthError.
+	Token(req models.TokenRequest, device models.Device) (models.AccessToken, error)
+
+	// RefreshToken returns a new AccessToken for the given user ID and
+	// refresh token ID, used from the given device. Effectively, refreshing
+	// the authenticated access. Refresh tokens are single-use; presenting a
+	// used refresh token revokes every refresh token of its family.
+	RefreshToken(id, tokenId string, device models.Device) (models.AccessToken, error)
+
+	// ValidateAuthorizationRequest returns nil if the given authorization
+	// request is valid. ErrorClientInvalid and ErrorRedirectInvalid are
+	// returned when the client can't be redirected to, otherwise errors are
+	// returned as a models.OAuthError.
+	ValidateAuthorizationRequest(req models.AuthorizationRequest) error
 
 	// ValidateOtp returns a new AccessToken if the given OTP was valid for
-	// the user ID.
-	ValidateOtp(id, otp string) (models.AccessToken, error)
+	// the user of the given OTP transaction token, starting a session for the
+	// given device.
+	ValidateOtp(tkn, otp string, device models.Device) (models.AccessToken, error)
+
+	// ValidateToken returns nil if the given token is still in good
+	// standing; I.e. it has not been revoked and its session is active. The
+	// token's signature and expiration are expected to have been validated
+	// already.
+	ValidateToken(tkn string) error
 }
 
 // controller implements the authentication service interface.
 type controller struct {
-	ctx        context.Context
-	db         database.Database // Users database
-	privateKey []byte            // JSON web token private key
-	publicKey  []byte            // JSON web token public key
-	cert       jwk.Certificate   // JSON-Web key certificate
-	issuer     string            // TOTP issuer
+	ctx             context.Context
+	db              database.Database        // Users database
+	privateKey      []byte                   // JSON web token private key
+	publicKey       []byte                   // JSON web token public key
+	cert            jwk.Certificate          // JSON-Web key certificate
+	issuer          string                   // TOTP issuer
+	sessionIdle     time.Duration            // Session idle timeout
+	sessionLifetime time.Duration            // Session absolute lifetime
+	clients         map[string]models.Client // Registered OAuth clients
+	clientGrants    map[string]grants.Grant  // Grants of service clients
+	tokenIssuer     string                   // Token issuer
 }
 
 // Config represents the configuration of an authentication service controller.
@@ -112,7 +235,13 @@ type Config struct {
 	PrivateKey  string   `toml:"private_key"`
 	Certificate string   `toml:"certificate"`
 	TotpIssuer  string   `toml:"totp_issuer"`
+	Issuer      string   `toml:"issuer"`
 	AuthGrants  []string `toml:"auth_grants"`
+
+	SessionIdleTimeout int `toml:"session_idle_timeout"` // in seconds
+	SessionLifetime    int `toml:"session_lifetime"`     // in seconds
+
+	Clients []models.Client `toml:"clients"`
 }
 
 var control Controller
@@ -156,6 +285,16 @@ var Ctrl = func() Controller {
 			cert,
 			cfg.TotpIssuer,
 		)
+		control.SetSessionLifetimes(
+			time.Duration(cfg.SessionIdleTimeout)*time.Second,
+			time.Duration(cfg.SessionLifetime)*time.Second,
+		)
+		if err := control.SetClients(cfg.Clients); err != nil {
+			panic(fmt.Sprintf("Controller: %s", err))
+		}
+		if cfg.Issuer != "" {
+			control.SetTokenIssuer(cfg.Issuer)
+		}
 	})
 	return control
 }
@@ -169,11 +308,29 @@ func New(
 	cert jwk.Certificate,
 	totpIssuer string,
 ) Controller {
-	return &controller{ctx, db, privateKey, publicKey, cert, totpIssuer}
+	return &controller{
+		ctx:             ctx,
+		db:              db,
+		privateKey:      privateKey,
+		publicKey:       publicKey,
+		cert:            cert,
+		issuer:          totpIssuer,
+		sessionIdle:     DefaultSessionIdle,
+		sessionLifetime: DefaultSessionLifetime,
+		clients:         map[string]models.Client{},
+		clientGrants:    map[string]grants.Grant{},
+		tokenIssuer:     DefaultTokenIssuer,
+	}
 }
 
-func (c *controller) GenerateTokens(user models.User) (models.AccessToken, error) {
-	options := &TokenOptions{}
+// GenerateTokens returns a new AccessToken for the given user, the device they
+// authenticated from and the token options; E.g. the OAuth client the user
+// authenticated for. If TOTP is enabled for the user, only a short-lived access
+// token is returned for completing the OTP transaction.
+func (c *controller) GenerateTokens(user models.User, device models.Device, options *TokenOptions) (models.AccessToken, error) {
+	if options == nil {
+		options = &TokenOptions{}
+	}
 	if user.TotpEnabled {
 		// If TOTP is enabled then we only need a short-lived access
 		// token to complete the OTP transaction.
@@ -181,26 +338,200 @@ func (c *controller) GenerateTokens(user models.User) (models.AccessToken, error
 		options.TTL = TransactionTokenExpiration
 		options.SkipRefresh = true
 	}
+	return c.generateTokens(user, device, options)
+}
+
+// generateTokens returns a new AccessToken for the given user, device and
+// token options. Unless skipped, the refresh token is recorded as part of the
+// token family set in the options; if no family is set, a new one is started
+// along with a session for the device. An ID token accompanies the access token
+// only once the user has authenticated; I.e. it has a refresh token.
+func (c *controller) generateTokens(user models.User, device models.Device, options *TokenOptions) (models.AccessToken, error) {
+	options.Issuer = c.tokenIssuer
+	if !options.SkipRefresh {
+		if options.FamilyId == "" {
+			session, err := c.startSession(user, device, options)
+			if err != nil {
+				return models.AccessToken{}, err
+			}
+			options.FamilyId = session.SessionId
+			options.AuthTime = session.CreatedAt
+		}
+		options.RefreshTokenId = uuid.New().String()
+	}
 	tkn, refreshTkn, err := GenerateTokens(user, c.publicKey, c.privateKey,
 		options)
 	if err != nil {
 		return models.AccessToken{}, err
 	}
-	if err := c.db.UpdateTokens(tkn, refreshTkn, user.UserId); err != nil {
-		return models.AccessToken{}, err
+	if !options.SkipRefresh {
+		refreshTtl := RefreshTokenExpiration
+		if options.RefreshTTL > time.Duration(0) {
+			refreshTtl = options.RefreshTTL
+		}
+		err := c.db.SaveRefreshToken(models.RefreshToken{
+			TokenId:   options.RefreshTokenId,
+			FamilyId:  options.FamilyId,
+			UserId:    user.UserId,
+			ExpiresAt: time.Now().Add(refreshTtl),
+		})
+		if err != nil {
+			return models.AccessToken{}, err
+		}
+	}
+	idTkn := ""
+	if !options.SkipRefresh {
+		idTkn, err = GenerateIdToken(user, c.publicKey, c.privateKey,
+			options)
+		if err != nil {
+			return models.AccessToken{}, err
+		}
 	}
 	return models.AccessToken{
 		Token:        tkn,
 		RefreshToken: refreshTkn,
+		IdToken:      idTkn,
 		OtpRequired:  user.TotpEnabled,
 	}, nil
 }
 
+// startSession starts and returns a new session for the given user and
+// device. The session remembers the OAuth client and nonce of the given token
+// options for the tokens issued when it is refreshed.
+func (c *controller) startSession(user models.User, device models.Device, options *TokenOptions) (models.Session, error) {
+	// Truncate to the precision of the auth_time claim
+	now := time.Now().Truncate(time.Second)
+	session := models.Session{
+		CreatedAt:   now,
+		SessionId:   uuid.New().String(),
+		UserId:      user.UserId,
+		UserAgent:   device.UserAgent,
+		IpAddress:   device.IpAddress,
+		LastUsedAt:  now,
+		IdleTimeout: int(c.sessionIdle / time.Second),
+		ExpiresAt:   now.Add(c.sessionLifetime),
+		ClientId:    options.ClientId,
+		Nonce:       options.Nonce,
+	}
+	if err := c.db.SaveSession(session); err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+// endSession ends the session for the given session ID, revoking the refresh
+// tokens of its family.
+func (c *controller) endSession(sessionId string) error {
+	if err := c.db.RevokeTokenFamily(sessionId); err != nil {
+		return err
+	}
+	return c.db.DeleteSession(sessionId)
+}
+
+func (c *controller) AuthenticateClient(clientId, secret string) (models.Client, error) {
+	client, ok := c.clients[clientId]
+	if !ok || !client.ValidSecret(secret) {
+		return models.Client{}, ErrorClientInvalid
+	}
+	return client, nil
+}
+
+func (c *controller) AuthorizeCode(req models.AuthorizationRequest, login models.Login, otp string) (string, error) {
+	if err := c.ValidateAuthorizationRequest(req); err != nil {
+		return "", err
+	}
+	foundUser, err := c.db.GetUserByName(strings.ToLower(login.Name))
+	if err != nil {
+		return "", ErrorBadCredentials
+	}
+	if err := VerifyPassword(foundUser.Password, login.Password); err != nil {
+		return "", ErrorBadCredentials
+	}
+	if foundUser.TotpEnabled {
+		if otp == "" {
+			return "", ErrorOtpRequired
+		}
+		totp, err := DecodeTotp(foundUser.Totp, c.issuer)
+		if err != nil {
+			return "", err
+		}
+		if err := totp.Validate(otp); err != nil {
+			return "", ErrorOtpInvalid
+		}
+	}
+	code, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
+	err = c.db.SaveAuthorizationCode(models.AuthorizationCode{
+		CodeHash:      HashToken(code),
+		ClientId:      req.ClientId,
+		UserId:        foundUser.UserId,
+		RedirectUri:   req.RedirectUri,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(AuthorizationCodeExpiration),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (c *controller) DeleteSession(id, sessionId string) error {
+	session, err := c.db.GetSession(sessionId)
+	if err != nil || session.UserId != id {
+		return ErrorSessionNotFound
+	}
+	return c.endSession(sessionId)
+}
+
 func (c *controller) GetJwks() (jwk.Jwks, error) {
 	webKey, err := c.cert.ToJwk()
 	return jwk.Jwks{Keys: []jwk.Jwk{webKey}}, err
 }
 
+func (c *controller) GetOpenIdConfiguration() models.OpenIdConfiguration {
+	issuer := strings.TrimRight(c.tokenIssuer, "/")
+	return models.OpenIdConfiguration{
+		Issuer:                issuer,
+		AuthorizationEndpoint: issuer + "/oauth/authorize",
+		TokenEndpoint:         issuer + "/oauth/token",
+		UserInfoEndpoint:      issuer + "/userinfo",
+		JwksUri:               issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint: issuer + "/oauth/introspect",
+		ScopesSupported:       []string{"openid", "profile", "email", "phone"},
+		ResponseTypesSupported: []string{
+			models.ResponseTypeCode,
+		},
+		GrantTypesSupported: []string{
+			models.GrantTypeAuthorizationCode,
+			models.GrantTypeRefreshToken,
+			models.GrantTypeClientCredentials,
+		},
+		CodeChallengeMethodsSupported: []string{
+			models.CodeChallengeMethodS256,
+		},
+		SubjectTypesSupported: []string{"public"},
+		IdTokenSigningAlgValuesSupported: []string{
+			algorithms.AlgorithmRS256.Name(),
+		},
+		TokenEndpointAuthMethodsSupported: []string{
+			"client_secret_basic",
+			"client_secret_post",
+			"private_key_jwt",
+			"none",
+		},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"name", "given_name", "family_name",
+			"preferred_username", "email", "phone_number",
+			"updated_at",
+		},
+	}
+}
+
 func (c *controller) GetOtpQr(id string) ([]byte, error) {
 	foundUser, err := c.db.GetUser(id)
 	if err != nil {
@@ -216,7 +547,84 @@ func (c *controller) GetOtpQr(id string) ([]byte, error) {
 	return nil, ErrorTotpNotFound
 }
 
-func (c *controller) Login(login models.Login) (models.AccessToken, error) {
+func (c *controller) GetSessions(id string) ([]models.Session, error) {
+	sessions, err := c.db.GetSessions(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := []models.Session{}
+	for _, session := range sessions {
+		if session.Active(now) {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+func (c *controller) GetUserInfo(id string) (models.UserInfo, error) {
+	foundUser, err := c.db.GetUser(id)
+	if err != nil {
+		return models.UserInfo{}, ErrorUserNotFound
+	}
+	return models.NewUserInfo(foundUser), nil
+}
+
+func (c *controller) Introspect(tkn string) (models.Introspection, error) {
+	inactive := models.Introspection{Active: false}
+	parsed, err := simplejwt.Parse(tkn)
+	if err != nil {
+		return inactive, nil
+	}
+	if err := parsed.Valid(c.publicKey); err != nil {
+		return inactive, nil
+	}
+	claim := func(name string) string {
+		v, _ := parsed.Claims.Get(name).(string)
+		return v
+	}
+	numericClaim := func(name string) int64 {
+		v, _ := parsed.Claims.Get(name).(float64)
+		return int64(v)
+	}
+	if claim(middleware.ClaimUserId) == "" {
+		return inactive, nil
+	}
+	err = c.ValidateToken(tkn)
+	if err == ErrorTokenRevoked {
+		return inactive, nil
+	} else if err != nil {
+		return models.Introspection{}, err
+	}
+	grant := claim(middleware.ClaimGrant)
+	if grant == grants.GrantUsersRefresh.String() {
+		// Refresh tokens are single-use, so one is only active until it
+		// has been exchanged.
+		foundTkn, err := c.db.GetRefreshToken(claim(ClaimTokenId))
+		if err != nil || foundTkn.Used || foundTkn.Revoked {
+			return inactive, nil
+		}
+	}
+	return models.Introspection{
+		Active:   true,
+		Scope:    strings.ReplaceAll(grant, grants.GrantDelimiter, " "),
+		Grant:    grant,
+		Sub:      claim(middleware.ClaimUserId),
+		Exp:      numericClaim("exp"),
+		Iat:      numericClaim("iat"),
+		Jti:      claim(ClaimTokenId),
+		Username: claim("username"),
+		Email:    claim("email"),
+		UserType: claim("user_type"),
+	}, nil
+}
+
+func (c *controller) Login(login models.Login, device models.Device) (models.AccessToken, error) {
+	if login.ClientId != "" {
+		if _, ok := c.clients[login.ClientId]; !ok {
+			return models.AccessToken{}, ErrorClientInvalid
+		}
+	}
 	login.Name = strings.ToLower(login.Name)
 	foundUser, err := c.db.GetUserByName(login.Name)
 	if err != nil {
@@ -225,10 +633,18 @@ func (c *controller) Login(login models.Login) (models.AccessToken, error) {
 	if err := VerifyPassword(foundUser.Password, login.Password); err != nil {
 		return models.AccessToken{}, ErrorBadCredentials
 	}
-	return c.GenerateTokens(foundUser)
+	return c.GenerateTokens(foundUser, device, &TokenOptions{
+		ClientId: login.ClientId,
+		Nonce:    login.Nonce,
+	})
 }
 
-func (c *controller) LoginWithPublicKey(signedKey models.SignedPublicKey) (models.AccessToken, error) {
+func (c *controller) LoginWithPublicKey(signedKey models.SignedPublicKey, device models.Device) (models.AccessToken, error) {
+	if signedKey.ClientId != "" {
+		if _, ok := c.clients[signedKey.ClientId]; !ok {
+			return models.AccessToken{}, ErrorClientInvalid
+		}
+	}
 	signedKey.User = strings.ToLower(signedKey.User)
 	foundUser, err := c.db.GetUserByName(signedKey.User)
 	if err != nil {
@@ -244,7 +660,55 @@ func (c *controller) LoginWithPublicKey(signedKey models.SignedPublicKey) (model
 	if err := signedKey.Valid(key); err != nil {
 		return models.AccessToken{}, err
 	}
-	return c.GenerateTokens(foundUser)
+	return c.GenerateTokens(foundUser, device, &TokenOptions{
+		ClientId: signedKey.ClientId,
+		Nonce:    signedKey.Nonce,
+	})
+}
+
+func (c *controller) Logout(tkn string) error {
+	uid, err := TokenClaim(tkn, middleware.ClaimUserId)
+	if err != nil {
+		return err
+	}
+	tokenId, err := TokenClaim(tkn, ClaimTokenId)
+	if err != nil {
+		return err
+	}
+	exp, err := TokenTimeClaim(tkn, "exp")
+	if err != nil {
+		return err
+	}
+	err = c.db.RevokeToken(models.RevokedToken{
+		TokenId:   tokenId,
+		UserId:    uid,
+		ExpiresAt: exp,
+	})
+	if err != nil {
+		return err
+	}
+	// Tokens that complete an OTP transaction don't belong to a session
+	if sessionId, _ := TokenClaim(tkn, ClaimFamilyId); sessionId != "" {
+		return c.endSession(sessionId)
+	}
+	return nil
+}
+
+func (c *controller) LogoutAll(id string) error {
+	if err := c.db.RevokeRefreshTokens(id); err != nil {
+		return err
+	}
+	if err := c.db.DeleteSessions(id); err != nil {
+		return err
+	}
+	// Revoke every access token issued before now, the revocation only
+	// needs to outlive the longest lived access token.
+	now := time.Now().Truncate(time.Second)
+	return c.db.RevokeToken(models.RevokedToken{
+		CreatedAt: now,
+		UserId:    id,
+		ExpiresAt: now.Add(AccessTokenExpiration),
+	})
 }
 
 func (c *controller) RegisterPublicKey(signedKey models.SignedPublicKey) error {
@@ -286,6 +750,31 @@ func (c *controller) SetAuthPrivateKey(privKey io.Reader) error {
 	return nil
 }
 
+func (c *controller) SetClients(clients []models.Client) error {
+	registered := map[string]models.Client{}
+	clientGrants := map[string]grants.Grant{}
+	for _, client := range clients {
+		if client.ClientId == "" {
+			continue
+		}
+		grant := grants.GrantNone
+		if len(client.Grants) > 0 {
+			var err error
+			grant, err = grants.ToGrant(
+				strings.Join(client.Grants, grants.GrantDelimiter))
+			if err != nil {
+				return fmt.Errorf("client '%s': %s",
+					client.ClientId, err)
+			}
+		}
+		registered[client.ClientId] = client
+		clientGrants[client.ClientId] = grant
+	}
+	c.clients = registered
+	c.clientGrants = clientGrants
+	return nil
+}
+
 func (c *controller) SetDatabase(dialect, path string) error {
 	db, err := database.New(c.ctx, dialect, path)
 	if err != nil {
@@ -295,6 +784,21 @@ func (c *controller) SetDatabase(dialect, path string) error {
 	return nil
 }
 
+func (c *controller) SetSessionLifetimes(idle, lifetime time.Duration) {
+	if idle <= time.Duration(0) {
+		idle = DefaultSessionIdle
+	}
+	if lifetime <= time.Duration(0) {
+		lifetime = DefaultSessionLifetime
+	}
+	c.sessionIdle = idle
+	c.sessionLifetime = lifetime
+}
+
+func (c *controller) SetTokenIssuer(issuer string) {
+	c.tokenIssuer = issuer
+}
+
 func (c *controller) SetTotp(id string, totp models.Totp) (models.Totp, error) {
 	foundUser, err := c.db.GetUser(id)
 	if err != nil {
@@ -338,7 +842,7 @@ func (c *controller) SetTotpIssuer(issuer string) {
 	c.issuer = issuer
 }
 
-func (c *controller) SignUp(user models.User) (models.AccessToken, error) {
+func (c *controller) SignUp(user models.User, device models.Device) (models.AccessToken, error) {
 	user.Username = strings.ToLower(user.Username)
 	user.Email = strings.ToLower(user.Email)
 	if err := user.Valid(); err != nil {
@@ -359,7 +863,7 @@ func (c *controller) SignUp(user models.User) (models.AccessToken, error) {
 	if err != nil {
 		return models.AccessToken{}, err
 	}
-	tkns, err := c.GenerateTokens(user)
+	tkns, err := c.GenerateTokens(user, device, nil)
 	if err != nil {
 		return models.AccessToken{}, err
 	}
@@ -368,27 +872,267 @@ func (c *controller) SignUp(user models.User) (models.AccessToken, error) {
 	return tkns, err
 }
 
-func (c *controller) RefreshToken(id string) (models.AccessToken, error) {
-	foundUser, err := c.db.GetUser(id)
+func (c *controller) Token(req models.TokenRequest, device models.Device) (models.AccessToken, error) {
+	client, authenticated, err := c.authenticateTokenClient(req)
 	if err != nil {
-		return models.AccessToken{}, ErrorUserNotFound
+		return models.AccessToken{}, ErrorOAuthClient
+	}
+	switch req.GrantType {
+	case models.GrantTypeAuthorizationCode, models.GrantTypeRefreshToken,
+		models.GrantTypeClientCredentials:
+	default:
+		return models.AccessToken{}, ErrorOAuthGrantType
+	}
+	if !client.AllowsGrantType(req.GrantType) {
+		return models.AccessToken{}, ErrorOAuthUnauthorizedClient
+	}
+	switch req.GrantType {
+	case models.GrantTypeAuthorizationCode:
+		return c.exchangeCode(client, req, device)
+	case models.GrantTypeRefreshToken:
+		return c.exchangeRefreshToken(client, req, device)
+	}
+	// Only clients that can keep a secret act on their own behalf
+	if !authenticated {
+		return models.AccessToken{}, ErrorOAuthUnauthorizedClient
+	}
+	return c.clientCredentials(client, req)
+}
+
+// authenticateTokenClient returns the client of the given token request, and
+// whether it authenticated; either with its secret, or with a JWT assertion
+// signed by its private key. Public clients have neither to authenticate with,
+// they instead rely on PKCE.
+func (c *controller) authenticateTokenClient(req models.TokenRequest) (models.Client, bool, error) {
+	if req.ClientAssertionType != "" {
+		if req.ClientAssertionType != models.ClientAssertionTypeJwtBearer {
+			return models.Client{}, false, ErrorClientInvalid
+		}
+		client, err := c.verifyClientAssertion(req.ClientId,
+			req.ClientAssertion)
+		return client, err == nil, err
+	}
+	client, ok := c.clients[req.ClientId]
+	if !ok {
+		return models.Client{}, false, ErrorClientInvalid
+	}
+	if client.Public() && req.ClientSecret == "" {
+		return client, false, nil
+	}
+	client, err := c.AuthenticateClient(req.ClientId, req.ClientSecret)
+	return client, err == nil, err
+}
+
+// verifyClientAssertion returns the client of the given private_key_jwt
+// assertion, as described by RFC 7523. The assertion must be issued by the
+// client about itself for the authentication service, and is single-use. The
+// client ID is optional, since the assertion identifies the client already.
+func (c *controller) verifyClientAssertion(clientId, assertion string) (models.Client, error) {
+	parsed, err := simplejwt.Parse(assertion)
+	if err != nil {
+		return models.Client{}, ErrorClientInvalid
+	}
+	claim := func(name string) string {
+		v, _ := parsed.Claims.Get(name).(string)
+		return v
+	}
+	iss := claim("iss")
+	if clientId == "" {
+		clientId = iss
+	}
+	client, ok := c.clients[clientId]
+	if !ok || client.PublicKey == "" || iss != clientId ||
+		claim("sub") != clientId || claim(ClaimTokenId) == "" {
+		return models.Client{}, ErrorClientInvalid
+	}
+	// The public key is not a secret, so an HMAC assertion keyed with it
+	// would be trivial to forge.
+	alg, _ := parsed.Header["alg"].(string)
+	if strings.HasPrefix(strings.ToUpper(alg), "HS") {
+		return models.Client{}, ErrorClientInvalid
+	}
+	exp, _ := parsed.Claims.Get("exp").(float64)
+	if exp <= 0 {
+		return models.Client{}, ErrorClientInvalid
+	}
+	issuer := strings.TrimRight(c.tokenIssuer, "/")
+	if !AudienceContains(parsed.Claims.Get("aud"), issuer,
+		issuer+"/oauth/token") {
+		return models.Client{}, ErrorClientInvalid
+	}
+	if err := parsed.Valid([]byte(client.PublicKey)); err != nil {
+		return models.Client{}, ErrorClientInvalid
+	}
+	// Record the assertion's ID for as long as the assertion is valid, so
+	// that it can't be replayed.
+	assertionId := client.ClientId + ":" + claim(ClaimTokenId)
+	used, err := c.db.IsTokenRevoked(assertionId, "", time.Time{})
+	if err != nil || used {
+		return models.Client{}, ErrorClientInvalid
+	}
+	err = c.db.RevokeToken(models.RevokedToken{
+		TokenId:   assertionId,
+		UserId:    client.ClientId,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	})
+	if err != nil {
+		return models.Client{}, err
+	}
+	return client, nil
+}
+
+// clientCredentials returns a new AccessToken for the given service client.
+// The token carries the grants configured for the client, narrowed to the
+// request's scope if given. No refresh token is issued; the client simply
+// requests a new token.
+func (c *controller) clientCredentials(client models.Client, req models.TokenRequest) (models.AccessToken, error) {
+	grant := c.clientGrants[client.ClientId]
+	if scope := strings.Fields(req.Scope); len(scope) > 0 {
+		requested, err := grants.ToGrant(
+			strings.Join(scope, grants.GrantDelimiter))
+		if err != nil || requested&grant != requested {
+			return models.AccessToken{}, ErrorOAuthScope
+		}
+		grant = requested
+	}
+	tkn, err := GenerateClientToken(client, c.publicKey, c.privateKey,
+		&TokenOptions{Grant: grant, Issuer: c.tokenIssuer})
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	return models.AccessToken{Token: tkn}, nil
+}
+
+// exchangeCode returns a new AccessToken for the authorization code of the
+// given token request. The code must have been issued to the given client for
+// the same redirect URI, and the request's code verifier must match the code's
+// challenge.
+func (c *controller) exchangeCode(client models.Client, req models.TokenRequest, device models.Device) (models.AccessToken, error) {
+	if req.Code == "" {
+		return models.AccessToken{}, ErrorOAuthGrant
 	}
-	tkn, refreshTkn, err := GenerateTokens(foundUser, c.publicKey,
-		c.privateKey, nil)
+	code, err := c.db.UseAuthorizationCode(HashToken(req.Code))
 	if err != nil {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	if code.ClientId != client.ClientId ||
+		code.RedirectUri != req.RedirectUri ||
+		!time.Now().Before(code.ExpiresAt) ||
+		!VerifyCodeChallenge(code.CodeChallenge, req.CodeVerifier) {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	foundUser, err := c.db.GetUser(code.UserId)
+	if err != nil {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	// The user has already completed any OTP transaction to get the code
+	return c.generateTokens(foundUser, device, &TokenOptions{
+		ClientId: client.ClientId,
+		Nonce:    code.Nonce,
+	})
+}
+
+// exchangeRefreshToken returns a new AccessToken for the refresh token of the
+// given token request. The refresh token's session must belong to the given
+// client.
+func (c *controller) exchangeRefreshToken(client models.Client, req models.TokenRequest, device models.Device) (models.AccessToken, error) {
+	parsed, err := simplejwt.Parse(req.RefreshToken)
+	if err != nil {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	if err := parsed.Valid(c.publicKey); err != nil {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	grant, _ := parsed.Claims.Get(middleware.ClaimGrant).(string)
+	uid, _ := parsed.Claims.Get(middleware.ClaimUserId).(string)
+	tokenId, _ := parsed.Claims.Get(ClaimTokenId).(string)
+	sessionId, _ := parsed.Claims.Get(ClaimFamilyId).(string)
+	if grant != grants.GrantUsersRefresh.String() || tokenId == "" {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	session, err := c.db.GetSession(sessionId)
+	if err != nil || session.ClientId != client.ClientId {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	tkns, err := c.RefreshToken(uid, tokenId, device)
+	if err == ErrorRefreshRequired ||
+		err == ErrorRefreshInvalid ||
+		err == ErrorRefreshReused ||
+		err == ErrorSessionExpired ||
+		err == ErrorUserNotFound {
+		return models.AccessToken{}, ErrorOAuthGrant
+	}
+	return tkns, err
+}
+
+func (c *controller) RefreshToken(id, tokenId string, device models.Device) (models.AccessToken, error) {
+	if tokenId == "" {
+		return models.AccessToken{}, ErrorRefreshRequired
+	}
+	foundTkn, err := c.db.GetRefreshToken(tokenId)
+	if err != nil || foundTkn.UserId != id || foundTkn.Revoked {
+		return models.AccessToken{}, ErrorRefreshInvalid
+	}
+	err = c.db.UseRefreshToken(tokenId)
+	if err == database.ErrRefreshTokenUsed {
+		// A refresh token being presented twice means it has likely
+		// been leaked; end the whole family so neither the legitimate
+		// holder nor the attacker can continue with it.
+		if err := c.db.RevokeTokenFamily(foundTkn.FamilyId); err != nil {
+			return models.AccessToken{}, err
+		}
+		return models.AccessToken{}, ErrorRefreshReused
+	} else if err != nil {
 		return models.AccessToken{}, err
 	}
-	if err := c.db.UpdateTokens(tkn, refreshTkn, foundUser.UserId); err != nil {
+	session, err := c.db.GetSession(foundTkn.FamilyId)
+	if err != nil {
+		return models.AccessToken{}, ErrorSessionExpired
+	}
+	if !session.Active(time.Now()) {
+		if err := c.endSession(session.SessionId); err != nil {
+			return models.AccessToken{}, err
+		}
+		return models.AccessToken{}, ErrorSessionExpired
+	}
+	if err := c.db.TouchSession(session.SessionId, device.IpAddress); err != nil {
 		return models.AccessToken{}, err
 	}
-	return models.AccessToken{
-		Token:        tkn,
-		RefreshToken: refreshTkn,
-		OtpRequired:  foundUser.TotpEnabled,
-	}, nil
+	foundUser, err := c.db.GetUser(id)
+	if err != nil {
+		return models.AccessToken{}, ErrorUserNotFound
+	}
+	return c.generateTokens(foundUser, device, &TokenOptions{
+		FamilyId: session.SessionId,
+		ClientId: session.ClientId,
+		Nonce:    session.Nonce,
+		AuthTime: session.CreatedAt,
+	})
+}
+
+func (c *controller) ValidateAuthorizationRequest(req models.AuthorizationRequest) error {
+	client, ok := c.clients[req.ClientId]
+	if !ok {
+		return ErrorClientInvalid
+	}
+	if !client.ValidRedirectUri(req.RedirectUri) {
+		return ErrorRedirectInvalid
+	}
+	if req.ResponseType != models.ResponseTypeCode {
+		return ErrorOAuthResponseType
+	}
+	if req.CodeChallengeMethod != models.CodeChallengeMethodS256 ||
+		req.CodeChallenge == "" {
+		return ErrorOAuthCodeChallenge
+	}
+	return nil
 }
 
-func (c *controller) ValidateOtp(id, otp string) (models.AccessToken, error) {
+func (c *controller) ValidateOtp(tkn, otp string, device models.Device) (models.AccessToken, error) {
+	id, err := TokenClaim(tkn, middleware.ClaimUserId)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
 	foundUser, err := c.db.GetUser(id)
 	if err != nil {
 		return models.AccessToken{}, ErrorUserNotFound
@@ -400,17 +1144,41 @@ func (c *controller) ValidateOtp(id, otp string) (models.AccessToken, error) {
 	if err := totp.Validate(otp); err != nil {
 		return models.AccessToken{}, err
 	}
-	tkn, refreshTkn, err := GenerateTokens(foundUser, c.publicKey,
-		c.privateKey, nil)
+	// The transaction token carries the OAuth client of the login it is
+	// completing.
+	clientId, _ := TokenClaim(tkn, ClaimClientId)
+	nonce, _ := TokenClaim(tkn, ClaimNonce)
+	return c.generateTokens(foundUser, device, &TokenOptions{
+		ClientId: clientId,
+		Nonce:    nonce,
+	})
+}
+
+func (c *controller) ValidateToken(tkn string) error {
+	uid, err := TokenClaim(tkn, middleware.ClaimUserId)
 	if err != nil {
-		return models.AccessToken{}, err
+		return err
 	}
-	if err := c.db.UpdateTokens(tkn, refreshTkn, foundUser.UserId); err != nil {
-		return models.AccessToken{}, err
+	// Tokens issued before revocation was supported don't have an ID, only
+	// a user-wide revocation applies to them.
+	tokenId, _ := TokenClaim(tkn, ClaimTokenId)
+	iat, err := TokenTimeClaim(tkn, "iat")
+	if err != nil {
+		return err
 	}
-	return models.AccessToken{
-		Token:        tkn,
-		RefreshToken: refreshTkn,
-		OtpRequired:  foundUser.TotpEnabled,
-	}, nil
+	revoked, err := c.db.IsTokenRevoked(tokenId, uid, iat)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrorTokenRevoked
+	}
+	// A token's session ending ends the token along with it
+	if sessionId, _ := TokenClaim(tkn, ClaimFamilyId); sessionId != "" {
+		session, err := c.db.GetSession(sessionId)
+		if err != nil || !session.Active(time.Now()) {
+			return ErrorTokenRevoked
+		}
+	}
+	return nil
 }
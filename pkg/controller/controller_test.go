@@ -56,7 +56,7 @@ aQIDAQAB
 
 func TestSetAuthPrivateKey(t *testing.T) {
 	ctx := context.Background()
-	ctr := &controller{ctx, nil, nil, nil, jwk.Certificate{}, ""}
+	ctr := &controller{ctx: ctx}
 	expected := []byte("Hello World")
 	ctr.SetAuthPrivateKey(bytes.NewBuffer(expected))
 	require.Equal(t, expected, ctr.privateKey)
@@ -80,7 +80,7 @@ func TestSetAuthCert(t *testing.T) {
 	require.Nil(t, err)
 	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
 	ctx := context.Background()
-	ctr := &controller{ctx, nil, nil, nil, jwk.Certificate{}, ""}
+	ctr := &controller{ctx: ctx}
 	ctr.SetAuthCert(bytes.NewBuffer(certPem))
 	expected, err := jwk.NewCertificate(bytes.NewBuffer(certPem))
 	require.Equal(t, expected, ctr.cert)
@@ -88,7 +88,7 @@ func TestSetAuthCert(t *testing.T) {
 
 func TestSetTotpIssuer(t *testing.T) {
 	ctx := context.Background()
-	ctr := &controller{ctx, nil, nil, nil, jwk.Certificate{}, ""}
+	ctr := &controller{ctx: ctx}
 	expected := "Hello World"
 	ctr.SetTotpIssuer(expected)
 	require.Equal(t, expected, ctr.issuer)
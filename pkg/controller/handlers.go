@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/crossedbot/common/golang/logger"
 	"github.com/crossedbot/common/golang/server"
@@ -47,8 +48,8 @@ func Login(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 		}, http.StatusBadRequest)
 		return
 	}
-	tkn, err := Ctrl().Login(login)
-	if err == ErrorBadCredentials {
+	tkn, err := Ctrl().Login(login, DeviceFromRequest(r))
+	if err == ErrorBadCredentials || err == ErrorClientInvalid {
 		logger.Error(err)
 		server.JsonResponse(w, server.Error{
 			Code: server.ErrProcessingRequestCode,
@@ -86,8 +87,17 @@ func LoginWithPublicKey(w http.ResponseWriter, r *http.Request, p server.Paramet
 		}, http.StatusBadRequest)
 		return
 	}
-	tkn, err := Ctrl().LoginWithPublicKey(signedKey)
-	if err != nil {
+	tkn, err := Ctrl().LoginWithPublicKey(signedKey, DeviceFromRequest(r))
+	if err == ErrorClientInvalid {
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed public key authentication: %s",
+				err,
+			),
+		}, http.StatusBadRequest)
+		return
+	} else if err != nil {
 		logger.Error(err)
 		server.JsonResponse(w, server.Error{
 			Code: server.ErrProcessingRequestCode,
@@ -101,6 +111,41 @@ func LoginWithPublicKey(w http.ResponseWriter, r *http.Request, p server.Paramet
 	server.JsonResponse(w, &tkn, http.StatusOK)
 }
 
+// Logout handles a request to logout the session of the request's access
+// token.
+func Logout(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	// Any valid token may end its own session, so no grant is required
+	if err := Ctrl().Logout(BearerToken(r)); err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to logout; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll handles a request to logout every session of the request's user.
+func LogoutAll(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
+	if err := Ctrl().LogoutAll(uid); err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to logout all sessions; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // RegisterPublicKey handles a request to register the public key for a given
 // user.
 func RegisterPublicKey(w http.ResponseWriter, r *http.Request, p server.Parameters) {
@@ -186,7 +231,7 @@ func SignUp(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 		}, http.StatusBadRequest)
 		return
 	}
-	tkn, err := Ctrl().SignUp(user)
+	tkn, err := Ctrl().SignUp(user, DeviceFromRequest(r))
 	if err != nil {
 		logger.Error(err)
 		server.JsonResponse(w, server.Error{
@@ -247,7 +292,6 @@ func ValidateOtp(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 		}, http.StatusForbidden)
 		return
 	}
-	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
 	otp := p.Get("otp")
 	if otp == "" {
 		server.JsonResponse(w, server.Error{
@@ -256,7 +300,8 @@ func ValidateOtp(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 		}, http.StatusBadRequest)
 		return
 	}
-	tkn, err := Ctrl().ValidateOtp(uid, otp)
+	tkn, err := Ctrl().ValidateOtp(BearerToken(r), otp,
+		DeviceFromRequest(r))
 	if err != nil {
 		logger.Error(err)
 		server.JsonResponse(w, server.Error{
@@ -310,8 +355,25 @@ func RefreshToken(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 		return
 	}
 	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
-	refreshedToken, err := Ctrl().RefreshToken(uid)
-	if err != nil {
+	// Only refresh tokens carry an ID; so an access token presented here
+	// is refused.
+	tokenId, _ := TokenClaim(BearerToken(r), ClaimTokenId)
+	refreshedToken, err := Ctrl().RefreshToken(uid, tokenId,
+		DeviceFromRequest(r))
+	if err == ErrorRefreshRequired ||
+		err == ErrorRefreshInvalid ||
+		err == ErrorRefreshReused ||
+		err == ErrorSessionExpired {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrUnauthorizedCode,
+			Message: fmt.Sprintf(
+				"Failed to refresh access token; %s",
+				err,
+			),
+		}, http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		logger.Error(err)
 		server.JsonResponse(w, server.Error{
 			Code: server.ErrProcessingRequestCode,
@@ -325,6 +387,44 @@ func RefreshToken(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 	server.JsonResponse(w, &refreshedToken, http.StatusOK)
 }
 
+// Introspect handles the response to a client's request for the state of a
+// token.
+func Introspect(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	clientId, secret := ClientCredentials(r)
+	if _, err := Ctrl().AuthenticateClient(clientId, secret); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="simpleauth"`)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrUnauthorizedCode,
+			Message: fmt.Sprintf(
+				"Failed to introspect token; %s",
+				err,
+			),
+		}, http.StatusUnauthorized)
+		return
+	}
+	tkn := r.PostFormValue("token")
+	if tkn == "" {
+		server.JsonResponse(w, server.Error{
+			Code:    server.ErrRequiredParamCode,
+			Message: "Form parameter 'token' is required",
+		}, http.StatusBadRequest)
+		return
+	}
+	introspection, err := Ctrl().Introspect(tkn)
+	if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to introspect token; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	server.JsonResponse(w, &introspection, http.StatusOK)
+}
+
 // GetJwk handles the response to a request for the service's JSON web key.
 func GetJwk(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 	jwks, err := Ctrl().GetJwks()
@@ -341,3 +441,278 @@ func GetJwk(w http.ResponseWriter, r *http.Request, p server.Parameters) {
 	}
 	server.JsonResponse(w, &jwks, http.StatusOK)
 }
+
+// GetOpenIdConfiguration handles the response to a request for the service's
+// OpenID Connect discovery document.
+func GetOpenIdConfiguration(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	cfg := Ctrl().GetOpenIdConfiguration()
+	server.JsonResponse(w, &cfg, http.StatusOK)
+}
+
+// GetUserInfo handles the response to a request for the OpenID Connect claims
+// of the user.
+func GetUserInfo(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	if err := grants.ContainsGrant(grants.GrantAuthenticated, r); err != nil {
+		server.JsonResponse(w, server.Error{
+			Code:    server.ErrUnauthorizedCode,
+			Message: "Not authorized to perform this action",
+		}, http.StatusForbidden)
+		return
+	}
+	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
+	info, err := Ctrl().GetUserInfo(uid)
+	if err == ErrorUserNotFound {
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrNotFoundCode,
+			Message: fmt.Sprintf(
+				"Failed to get user info; %s",
+				err,
+			),
+		}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to get user info; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	server.JsonResponse(w, &info, http.StatusOK)
+}
+
+// GetSessions handles the response to a request for the user's sessions.
+func GetSessions(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
+	sessions, err := Ctrl().GetSessions(uid)
+	if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to get sessions; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	current, _ := TokenClaim(BearerToken(r), ClaimFamilyId)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SessionId == current
+	}
+	server.JsonResponse(w, &sessions, http.StatusOK)
+}
+
+// DeleteSession handles the response to a request to end one of the user's
+// sessions.
+func DeleteSession(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	uid, _ := r.Context().Value(middleware.ClaimUserId).(string)
+	id := p.Get("id")
+	if id == "" {
+		server.JsonResponse(w, server.Error{
+			Code:    server.ErrRequiredParamCode,
+			Message: "Path parameter 'id' is required",
+		}, http.StatusBadRequest)
+		return
+	}
+	err := Ctrl().DeleteSession(uid, id)
+	if err == ErrorSessionNotFound {
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrNotFoundCode,
+			Message: fmt.Sprintf(
+				"Failed to delete session; %s",
+				err,
+			),
+		}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to delete session; %s",
+				err,
+			),
+		}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizePage represents the data of the OAuth authorization login page.
+type authorizePage struct {
+	Action      string
+	Request     models.AuthorizationRequest
+	Name        string
+	Message     string
+	OtpRequired bool
+}
+
+// renderAuthorize writes the OAuth authorization login page for the given page
+// data and status.
+func renderAuthorize(w http.ResponseWriter, page authorizePage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page collects credentials, so it must not be framed
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := authorizeTemplate.Execute(w, page); err != nil {
+		logger.Error(err)
+	}
+}
+
+// redirectAuthorize redirects the user agent back to the client of the given
+// authorization request, along with the given parameters and the request's
+// state.
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, req models.AuthorizationRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectUri)
+	if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrProcessingRequestCode,
+			Message: fmt.Sprintf(
+				"Failed to authorize; %s",
+				err,
+			),
+		}, http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// authorizeError handles the response to an OAuth authorization request that
+// failed with the given error. Only requests with a valid client and redirect
+// URI are redirected back to the client.
+func authorizeError(w http.ResponseWriter, r *http.Request, req models.AuthorizationRequest, err error) {
+	if oauthErr, ok := err.(models.OAuthError); ok {
+		redirectAuthorize(w, r, req, url.Values{
+			"error":             {oauthErr.Code},
+			"error_description": {oauthErr.Description},
+		})
+		return
+	}
+	status := http.StatusInternalServerError
+	if err == ErrorClientInvalid || err == ErrorRedirectInvalid {
+		status = http.StatusBadRequest
+	} else {
+		logger.Error(err)
+	}
+	server.JsonResponse(w, server.Error{
+		Code: server.ErrProcessingRequestCode,
+		Message: fmt.Sprintf(
+			"Failed to authorize; %s",
+			err,
+		),
+	}, status)
+}
+
+// OAuthAuthorize handles the response to an OAuth authorization request by
+// presenting the user with a login page.
+func OAuthAuthorize(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	req := models.NewAuthorizationRequest(r.URL.Query())
+	if err := Ctrl().ValidateAuthorizationRequest(req); err != nil {
+		authorizeError(w, r, req, err)
+		return
+	}
+	renderAuthorize(w, authorizePage{
+		Action:  r.URL.Path,
+		Request: req,
+	}, http.StatusOK)
+}
+
+// OAuthLogin handles the response to the login of an OAuth authorization
+// request. On success, the user agent is redirected back to the client with an
+// authorization code.
+func OAuthLogin(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	if err := r.ParseForm(); err != nil {
+		server.JsonResponse(w, server.Error{
+			Code: server.ErrFailedConversionCode,
+			Message: fmt.Sprintf(
+				"Failed to parse request body; %s",
+				err,
+			),
+		}, http.StatusBadRequest)
+		return
+	}
+	req := models.NewAuthorizationRequest(r.PostForm)
+	login := models.Login{
+		Name:     r.PostFormValue("name"),
+		Password: r.PostFormValue("password"),
+	}
+	otp := r.PostFormValue("otp")
+	page := authorizePage{
+		Action:  r.URL.Path,
+		Request: req,
+		Name:    login.Name,
+	}
+	code, err := Ctrl().AuthorizeCode(req, login, otp)
+	switch err {
+	case nil:
+		redirectAuthorize(w, r, req, url.Values{"code": {code}})
+	case ErrorBadCredentials:
+		page.Message = err.Error()
+		page.OtpRequired = otp != ""
+		renderAuthorize(w, page, http.StatusUnauthorized)
+	case ErrorOtpRequired:
+		page.Message = err.Error()
+		page.OtpRequired = true
+		renderAuthorize(w, page, http.StatusOK)
+	case ErrorOtpInvalid:
+		page.Message = err.Error()
+		page.OtpRequired = true
+		renderAuthorize(w, page, http.StatusUnauthorized)
+	default:
+		authorizeError(w, r, req, err)
+	}
+}
+
+// OAuthToken handles the response to an OAuth token request.
+func OAuthToken(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := r.ParseForm(); err != nil {
+		server.JsonResponse(w, models.OAuthError{
+			Code:        models.OAuthErrorInvalidRequest,
+			Description: err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+	req := models.NewTokenRequest(r.PostForm)
+	req.ClientId, req.ClientSecret = ClientCredentials(r)
+	tkns, err := Ctrl().Token(req, DeviceFromRequest(r))
+	if oauthErr, ok := err.(models.OAuthError); ok {
+		status := http.StatusBadRequest
+		if oauthErr.Code == models.OAuthErrorInvalidClient {
+			w.Header().Set("WWW-Authenticate", `Basic realm="simpleauth"`)
+			status = http.StatusUnauthorized
+		}
+		server.JsonResponse(w, &oauthErr, status)
+		return
+	} else if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, models.OAuthError{
+			Code: models.OAuthErrorServerError,
+		}, http.StatusInternalServerError)
+		return
+	}
+	resp, err := NewTokenResponse(tkns)
+	if err != nil {
+		logger.Error(err)
+		server.JsonResponse(w, models.OAuthError{
+			Code: models.OAuthErrorServerError,
+		}, http.StatusInternalServerError)
+		return
+	}
+	server.JsonResponse(w, &resp, http.StatusOK)
+}
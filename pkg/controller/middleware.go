@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/crossedbot/common/golang/logger"
+	"github.com/crossedbot/common/golang/server"
+	middleware "github.com/crossedbot/simplemiddleware"
+)
+
+// Authorize wraps the given handler, authorizing requests by their bearer
+// token. Along with the checks of middleware.Authorize, the token must still be
+// in good standing with the authentication service; E.g. not revoked.
+func Authorize(handler server.Handler) server.Handler {
+	return middleware.Authorize(func(w http.ResponseWriter, r *http.Request, p server.Parameters) {
+		err := Ctrl().ValidateToken(BearerToken(r))
+		if err == ErrorTokenRevoked {
+			server.JsonResponse(w, server.Error{
+				Code:    server.ErrUnauthorizedCode,
+				Message: err.Error(),
+			}, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			logger.Error(err)
+			server.JsonResponse(w, server.Error{
+				Code:    server.ErrProcessingRequestCode,
+				Message: "Failed to validate token",
+			}, http.StatusInternalServerError)
+			return
+		}
+		handler(w, r, p)
+	})
+}
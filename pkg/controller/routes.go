@@ -4,7 +4,6 @@ import (
 	"net/http"
 
 	"github.com/crossedbot/common/golang/server"
-	middleware "github.com/crossedbot/simplemiddleware"
 )
 
 // Routes represent the authentication HTTP service routes.
@@ -22,13 +21,25 @@ var Routes = []server.Route{
 		ResponseSettings: []server.ResponseSetting{},
 	},
 	server.Route{
-		Handler:          middleware.Authorize(RefreshToken),
+		Handler:          Authorize(RefreshToken),
 		Method:           http.MethodGet,
 		Path:             "/users/refresh",
 		ResponseSettings: []server.ResponseSetting{},
 	},
 	server.Route{
-		Handler:          middleware.Authorize(RegisterPublicKey),
+		Handler:          Authorize(Logout),
+		Method:           http.MethodPost,
+		Path:             "/users/logout",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          Authorize(LogoutAll),
+		Method:           http.MethodPost,
+		Path:             "/users/logout/all",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          Authorize(RegisterPublicKey),
 		Method:           http.MethodPost,
 		Path:             "/keys",
 		ResponseSettings: []server.ResponseSetting{},
@@ -40,27 +51,75 @@ var Routes = []server.Route{
 		ResponseSettings: []server.ResponseSetting{},
 	},
 	server.Route{
-		Handler:          middleware.Authorize(SetTotp),
+		Handler:          Authorize(SetTotp),
 		Method:           http.MethodPost,
 		Path:             "/otp",
 		ResponseSettings: []server.ResponseSetting{},
 	},
 	server.Route{
-		Handler:          middleware.Authorize(ValidateOtp),
+		Handler:          Authorize(ValidateOtp),
 		Method:           http.MethodGet,
 		Path:             "/otp/validate/:otp",
 		ResponseSettings: []server.ResponseSetting{},
 	},
 	server.Route{
-		Handler:          middleware.Authorize(GetOtpQr),
+		Handler:          Authorize(GetOtpQr),
 		Method:           http.MethodGet,
 		Path:             "/otp/qr",
 		ResponseSettings: []server.ResponseSetting{},
 	},
+	server.Route{
+		Handler:          Authorize(GetSessions),
+		Method:           http.MethodGet,
+		Path:             "/sessions",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          Authorize(DeleteSession),
+		Method:           http.MethodDelete,
+		Path:             "/sessions/:id",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          Authorize(GetUserInfo),
+		Method:           http.MethodGet,
+		Path:             "/userinfo",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          OAuthAuthorize,
+		Method:           http.MethodGet,
+		Path:             "/oauth/authorize",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          OAuthLogin,
+		Method:           http.MethodPost,
+		Path:             "/oauth/authorize",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          OAuthToken,
+		Method:           http.MethodPost,
+		Path:             "/oauth/token",
+		ResponseSettings: []server.ResponseSetting{},
+	},
+	server.Route{
+		Handler:          Introspect,
+		Method:           http.MethodPost,
+		Path:             "/oauth/introspect",
+		ResponseSettings: []server.ResponseSetting{},
+	},
 	server.Route{
 		Handler:          GetJwk,
 		Method:           http.MethodGet,
 		Path:             "/.well-known/jwks.json",
 		ResponseSettings: []server.ResponseSetting{},
 	},
+	server.Route{
+		Handler:          GetOpenIdConfiguration,
+		Method:           http.MethodGet,
+		Path:             "/.well-known/openid-configuration",
+		ResponseSettings: []server.ResponseSetting{},
+	},
 }
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"html/template"
+)
+
+// authorizeTemplate is the login page presented to users during an OAuth
+// authorization request. The request's parameters are carried through the form
+// as hidden fields.
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Sign in</title>
+</head>
+<body>
+  <main>
+    <h1>Sign in</h1>
+    {{if .Message}}<p role="alert">{{.Message}}</p>{{end}}
+    <form method="post" action="{{.Action}}">
+      <input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+      <input type="hidden" name="client_id" value="{{.Request.ClientId}}">
+      <input type="hidden" name="redirect_uri" value="{{.Request.RedirectUri}}">
+      <input type="hidden" name="scope" value="{{.Request.Scope}}">
+      <input type="hidden" name="state" value="{{.Request.State}}">
+      <input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+      <input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+      <input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+      <label>Username or email <input type="text" name="name" value="{{.Name}}" autocomplete="username" required></label>
+      <label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+      {{if .OtpRequired}}<label>One-time password <input type="text" name="otp" inputmode="numeric" autocomplete="one-time-code" required></label>{{end}}
+      <button type="submit">Sign in</button>
+    </form>
+  </main>
+</body>
+</html>
+`))
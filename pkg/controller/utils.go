@@ -1,10 +1,18 @@
 package controller
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	commoncrypto "github.com/crossedbot/common/golang/crypto"
@@ -12,6 +20,7 @@ import (
 	"github.com/crossedbot/simplejwt/algorithms"
 	"github.com/crossedbot/simplejwt/jwk"
 	middleware "github.com/crossedbot/simplemiddleware"
+	"github.com/google/uuid"
 	"github.com/sec51/twofactor"
 	"golang.org/x/crypto/bcrypt"
 
@@ -24,6 +33,15 @@ const (
 	AccessTokenExpiration      = 1 * time.Hour
 	RefreshTokenExpiration     = 24 * time.Hour
 	TransactionTokenExpiration = 5 * time.Minute
+
+	// Authorization code TTL
+	AuthorizationCodeExpiration = 1 * time.Minute
+
+	// Token claims
+	ClaimTokenId  = "jti"
+	ClaimFamilyId = "fid"
+	ClaimClientId = "client_id"
+	ClaimNonce    = "nonce"
 )
 
 // HashPassword returns the bcrypt hash of the given password using the default
@@ -57,13 +75,24 @@ type TokenOptions struct {
 	TTL         time.Duration // Time-To-Live of the token
 	RefreshTTL  time.Duration // Time-To-Live of the refresh token
 	SkipRefresh bool          // Whether to skip generating a refresh token
+
+	RefreshTokenId string // ID of the refresh token
+	FamilyId       string // ID of the refresh token's family
+
+	Issuer   string    // Issuer of the ID token
+	ClientId string    // ID of the OAuth client the tokens are for
+	Nonce    string    // OpenID Connect nonce of the client
+	AuthTime time.Time // Time the user authenticated
 }
 
 // GenerateTokens returns a new access token, and an accompanying refresh token
 // for the given user, and encryption key pair. By default, the generated access
 // token will be given a grant of grants.GrantAuthenticated and a TTL of
 // AccessTokenExpiration. This can be changed in the given token options.
-// Skipping the refresh token, will return an empty string in its place.
+// Skipping the refresh token, will return an empty string in its place. The
+// access token is always given a unique ID, whereas the refresh token's ID and
+// the token family are only claimed when set in the options. Likewise for the
+// access token's client ID and nonce.
 func GenerateTokens(user models.User, pubKey, privKey []byte, options *TokenOptions) (string, string, error) {
 	grant := grants.GrantAuthenticated
 	if grants.IsCustomGrantsSet() {
@@ -80,13 +109,25 @@ func GenerateTokens(user models.User, pubKey, privKey []byte, options *TokenOpti
 	if options != nil && options.RefreshTTL > time.Duration(0) {
 		refreshTtl = options.RefreshTTL
 	}
+	now := time.Now().Local()
 	claims := simplejwt.CustomClaims{
 		"email":                user.Email,
 		"username":             user.Username,
 		middleware.ClaimUserId: user.UserId,
 		"user_type":            user.UserType,
-		"exp":                  time.Now().Local().Add(ttl).Unix(),
+		"exp":                  now.Add(ttl).Unix(),
+		"iat":                  now.Unix(),
 		middleware.ClaimGrant:  grant.Clean().Short(),
+		ClaimTokenId:           uuid.New().String(),
+	}
+	if options != nil && options.FamilyId != "" {
+		claims[ClaimFamilyId] = options.FamilyId
+	}
+	if options != nil && options.ClientId != "" {
+		claims[ClaimClientId] = options.ClientId
+	}
+	if options != nil && options.Nonce != "" {
+		claims[ClaimNonce] = options.Nonce
 	}
 	jwt := simplejwt.New(claims, algorithms.AlgorithmRS256)
 	jwt.Header["kid"] = jwk.EncodeToString(commoncrypto.KeyId(pubKey))
@@ -96,12 +137,18 @@ func GenerateTokens(user models.User, pubKey, privKey []byte, options *TokenOpti
 	}
 	refreshTkn := ""
 	if options == nil || !options.SkipRefresh {
-		exp := time.Now().Local().Add(refreshTtl).Unix()
 		refreshClaims := simplejwt.CustomClaims{
 			middleware.ClaimUserId: user.UserId,
-			"exp":                  exp,
+			"exp":                  now.Add(refreshTtl).Unix(),
+			"iat":                  now.Unix(),
 			middleware.ClaimGrant:  grants.GrantUsersRefresh.String(),
 		}
+		if options != nil && options.RefreshTokenId != "" {
+			refreshClaims[ClaimTokenId] = options.RefreshTokenId
+		}
+		if options != nil && options.FamilyId != "" {
+			refreshClaims[ClaimFamilyId] = options.FamilyId
+		}
 		refreshTkn, err = simplejwt.New(refreshClaims,
 			algorithms.AlgorithmRS256).Sign(privKey)
 		if err != nil {
@@ -111,6 +158,241 @@ func GenerateTokens(user models.User, pubKey, privKey []byte, options *TokenOpti
 	return tkn, refreshTkn, nil
 }
 
+// GenerateIdToken returns a new OpenID Connect ID token for the given user, and
+// encryption key pair. The token's audience is the client ID set in the token
+// options, falling back to the issuer when no client is set. Its TTL matches
+// that of the access token.
+func GenerateIdToken(user models.User, pubKey, privKey []byte, options *TokenOptions) (string, error) {
+	if options == nil {
+		options = &TokenOptions{}
+	}
+	ttl := AccessTokenExpiration
+	if options.TTL > time.Duration(0) {
+		ttl = options.TTL
+	}
+	audience := options.ClientId
+	if audience == "" {
+		audience = options.Issuer
+	}
+	authTime := options.AuthTime
+	now := time.Now().Local()
+	if authTime.IsZero() {
+		authTime = now
+	}
+	info := models.NewUserInfo(user)
+	claims := simplejwt.CustomClaims{
+		"iss":       options.Issuer,
+		"sub":       info.Sub,
+		"aud":       audience,
+		"exp":       now.Add(ttl).Unix(),
+		"iat":       now.Unix(),
+		"auth_time": authTime.Unix(),
+	}
+	if options.Nonce != "" {
+		claims[ClaimNonce] = options.Nonce
+	}
+	// Only include the profile claims that are set
+	profile := map[string]string{
+		"name":               info.Name,
+		"given_name":         info.GivenName,
+		"family_name":        info.FamilyName,
+		"preferred_username": info.PreferredUsername,
+		"email":              info.Email,
+		"phone_number":       info.PhoneNumber,
+	}
+	for k, v := range profile {
+		if v != "" {
+			claims[k] = v
+		}
+	}
+	jwt := simplejwt.New(claims, algorithms.AlgorithmRS256)
+	jwt.Header["kid"] = jwk.EncodeToString(commoncrypto.KeyId(pubKey))
+	return jwt.Sign(privKey)
+}
+
+// GenerateClientToken returns a new access token for the given service client,
+// and encryption key pair. The client is the token's subject, so unlike a
+// user's token it carries no user claims. The token is given the grant and TTL
+// set in the token options, the grant defaulting to grants.GrantNone.
+func GenerateClientToken(client models.Client, pubKey, privKey []byte, options *TokenOptions) (string, error) {
+	if options == nil {
+		options = &TokenOptions{}
+	}
+	grant := grants.GrantNone
+	if options.Grant != grants.GrantUnknown {
+		grant = options.Grant
+	}
+	ttl := AccessTokenExpiration
+	if options.TTL > time.Duration(0) {
+		ttl = options.TTL
+	}
+	now := time.Now().Local()
+	claims := simplejwt.CustomClaims{
+		middleware.ClaimUserId: client.ClientId,
+		"sub":                  client.ClientId,
+		ClaimClientId:          client.ClientId,
+		"exp":                  now.Add(ttl).Unix(),
+		"iat":                  now.Unix(),
+		middleware.ClaimGrant:  grant.Clean().Short(),
+		ClaimTokenId:           uuid.New().String(),
+	}
+	if options.Issuer != "" {
+		claims["iss"] = options.Issuer
+	}
+	jwt := simplejwt.New(claims, algorithms.AlgorithmRS256)
+	jwt.Header["kid"] = jwk.EncodeToString(commoncrypto.KeyId(pubKey))
+	return jwt.Sign(privKey)
+}
+
+// AudienceContains returns true if the given audience claim, either a string or
+// a list of strings, contains any of the given values.
+func AudienceContains(aud interface{}, values ...string) bool {
+	var audience []string
+	switch v := aud.(type) {
+	case string:
+		audience = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	for _, a := range audience {
+		for _, v := range values {
+			if a != "" && a == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewTokenResponse returns the OAuth token response for the given access
+// tokens.
+func NewTokenResponse(tkns models.AccessToken) (models.TokenResponse, error) {
+	exp, err := TokenTimeClaim(tkns.Token, "exp")
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	grant, err := TokenClaim(tkns.Token, middleware.ClaimGrant)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	expiresIn := int64(time.Until(exp) / time.Second)
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	return models.TokenResponse{
+		AccessToken:  tkns.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresIn,
+		RefreshToken: tkns.RefreshToken,
+		IdToken:      tkns.IdToken,
+		Scope:        strings.ReplaceAll(grant, grants.GrantDelimiter, " "),
+	}, nil
+}
+
+// RandomToken returns a new random, URL safe token; E.g. an authorization
+// code.
+func RandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the SHA-256 hash of the given token for storing it. Tokens
+// are random, so unlike passwords a fast hash suffices.
+func HashToken(tkn string) string {
+	sum := sha256.Sum256([]byte(tkn))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyCodeChallenge returns true if the given PKCE code verifier matches the
+// S256 code challenge.
+func VerifyCodeChallenge(challenge, verifier string) bool {
+	// RFC 7636 limits verifiers to between 43 and 128 characters
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// BearerToken returns the bearer token of the given request's authorization
+// header. If no bearer token is found, an empty string is returned.
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get(middleware.AuthHeader)
+	if len(h) >= 7 && strings.EqualFold(h[:7], "BEARER ") {
+		return h[7:]
+	}
+	return ""
+}
+
+// ClientCredentials returns the OAuth client ID and secret of the given
+// request. The credentials are read from the HTTP basic authorization header,
+// or otherwise from the client_id and client_secret form parameters.
+func ClientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		// RFC 6749 form-encodes the credentials before they are passed as
+		// basic authorization.
+		if v, err := url.QueryUnescape(id); err == nil {
+			id = v
+		}
+		if v, err := url.QueryUnescape(secret); err == nil {
+			secret = v
+		}
+		return id, secret
+	}
+	return r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+}
+
+// DeviceFromRequest returns the device of the client making the given request.
+func DeviceFromRequest(r *http.Request) models.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return models.Device{
+		UserAgent: r.UserAgent(),
+		IpAddress: ip,
+	}
+}
+
+// TokenClaim returns the string value of the named claim in the given token.
+// The token's signature is not validated, callers are expected to have done so
+// already; E.g. via middleware.Authorize.
+func TokenClaim(tkn, name string) (string, error) {
+	parsed, err := simplejwt.Parse(tkn)
+	if err != nil {
+		return "", err
+	}
+	v, ok := parsed.Claims.Get(name).(string)
+	if !ok {
+		return "", middleware.ErrClaimDataType
+	}
+	return v, nil
+}
+
+// TokenTimeClaim returns the time of the named NumericDate claim (E.g. "exp")
+// in the given token. If the claim is not set, the zero time is returned.
+func TokenTimeClaim(tkn, name string) (time.Time, error) {
+	parsed, err := simplejwt.Parse(tkn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch v := parsed.Claims.Get(name).(type) {
+	case nil:
+		return time.Time{}, nil
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("claim '%s' is not a numeric date", name)
+}
+
 // DecodeTotp returns the timed-based OTP for the given based64 encoded message
 // and the OTP issuer.
 func DecodeTotp(enc, issuer string) (*twofactor.Totp, error) {
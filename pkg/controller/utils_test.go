@@ -3,6 +3,10 @@ package controller
 import (
 	"crypto"
 	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -160,3 +164,188 @@ func TestEncodeTotp(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, expected, actual)
 }
+
+func TestGenerateTokensRefreshIds(t *testing.T) {
+	user := models.User{
+		Email:    "hello@world.com",
+		UserId:   "abc123",
+		UserType: models.BaseUserType.String(),
+	}
+	options := &TokenOptions{
+		RefreshTokenId: "def456",
+		FamilyId:       "ghi789",
+	}
+	tkn, rTkn, err := GenerateTokens(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	parsedTkn, err := jwt.Parse(tkn)
+	require.Nil(t, err)
+	require.NotEmpty(t, parsedTkn.Claims.Get(ClaimTokenId))
+	require.NotEqual(t, options.RefreshTokenId,
+		parsedTkn.Claims.Get(ClaimTokenId))
+	require.Equal(t, options.FamilyId,
+		parsedTkn.Claims.Get(ClaimFamilyId))
+	parsedRTkn, err := jwt.Parse(rTkn)
+	require.Nil(t, err)
+	require.Equal(t, options.RefreshTokenId,
+		parsedRTkn.Claims.Get(ClaimTokenId))
+	require.Equal(t, options.FamilyId,
+		parsedRTkn.Claims.Get(ClaimFamilyId))
+}
+
+func TestGenerateIdToken(t *testing.T) {
+	user := models.User{
+		UserId:    "abc123",
+		Username:  "jdoe",
+		FirstName: "John",
+	}
+	authTime := time.Now().Add(-1 * time.Minute).Truncate(time.Second)
+	options := &TokenOptions{
+		Issuer:   "https://auth.example.com",
+		ClientId: "myclient",
+		Nonce:    "n-0S6_WzA2Mj",
+		AuthTime: authTime,
+	}
+	idTkn, err := GenerateIdToken(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	parsed, err := jwt.Parse(idTkn)
+	require.Nil(t, err)
+	require.Nil(t, parsed.Valid([]byte(testPublicKey)))
+	require.Equal(t, options.Issuer, parsed.Claims.Get("iss"))
+	require.Equal(t, user.UserId, parsed.Claims.Get("sub"))
+	require.Equal(t, options.ClientId, parsed.Claims.Get("aud"))
+	require.Equal(t, options.Nonce, parsed.Claims.Get(ClaimNonce))
+	require.Equal(t, float64(authTime.Unix()),
+		parsed.Claims.Get("auth_time"))
+	require.Equal(t, user.Username, parsed.Claims.Get("preferred_username"))
+	require.Equal(t, user.FirstName, parsed.Claims.Get("given_name"))
+	require.Nil(t, parsed.Claims.Get("email"))
+
+	// Without a client the issuer is the audience
+	options = &TokenOptions{Issuer: "https://auth.example.com"}
+	idTkn, err = GenerateIdToken(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	parsed, err = jwt.Parse(idTkn)
+	require.Nil(t, err)
+	require.Equal(t, options.Issuer, parsed.Claims.Get("aud"))
+	require.Nil(t, parsed.Claims.Get(ClaimNonce))
+}
+
+func TestNewTokenResponse(t *testing.T) {
+	user := models.User{UserId: "abc123"}
+	options := &TokenOptions{TTL: 1 * time.Minute}
+	tkn, rTkn, err := GenerateTokens(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	tkns := models.AccessToken{
+		Token:        tkn,
+		RefreshToken: rTkn,
+		IdToken:      "idtoken",
+	}
+	resp, err := NewTokenResponse(tkns)
+	require.Nil(t, err)
+	require.Equal(t, tkn, resp.AccessToken)
+	require.Equal(t, rTkn, resp.RefreshToken)
+	require.Equal(t, "idtoken", resp.IdToken)
+	require.Equal(t, "Bearer", resp.TokenType)
+	require.InDelta(t, 60, resp.ExpiresIn, 1)
+	require.Equal(t, grants.GrantAuthenticated.Short(), resp.Scope)
+	_, err = NewTokenResponse(models.AccessToken{Token: "notatoken"})
+	require.NotNil(t, err)
+}
+
+func TestRandomToken(t *testing.T) {
+	tkn, err := RandomToken()
+	require.Nil(t, err)
+	require.Equal(t, 43, len(tkn))
+	other, err := RandomToken()
+	require.Nil(t, err)
+	require.NotEqual(t, tkn, other)
+}
+
+func TestHashToken(t *testing.T) {
+	expected := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	require.Equal(t, expected, HashToken("hello"))
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	require.True(t, VerifyCodeChallenge(challenge, verifier))
+	require.False(t, VerifyCodeChallenge(challenge, verifier+"a"))
+	require.False(t, VerifyCodeChallenge(challenge, ""))
+	require.False(t, VerifyCodeChallenge(challenge, challenge))
+	require.False(t, VerifyCodeChallenge("", verifier))
+}
+
+func TestBearerToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	require.Equal(t, "", BearerToken(r))
+	r.Header.Set(middleware.AuthHeader, "Basic abc123")
+	require.Equal(t, "", BearerToken(r))
+	r.Header.Set(middleware.AuthHeader, "Bearer abc123")
+	require.Equal(t, "abc123", BearerToken(r))
+}
+
+func TestTokenClaim(t *testing.T) {
+	user := models.User{UserId: "abc123"}
+	options := &TokenOptions{RefreshTokenId: "def456"}
+	_, rTkn, err := GenerateTokens(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	actual, err := TokenClaim(rTkn, ClaimTokenId)
+	require.Nil(t, err)
+	require.Equal(t, options.RefreshTokenId, actual)
+	_, err = TokenClaim(rTkn, "unknown")
+	require.NotNil(t, err)
+	_, err = TokenClaim("notatoken", ClaimTokenId)
+	require.NotNil(t, err)
+}
+
+func TestTokenTimeClaim(t *testing.T) {
+	user := models.User{UserId: "abc123"}
+	options := &TokenOptions{TTL: 1 * time.Minute}
+	tkn, _, err := GenerateTokens(user, []byte(testPublicKey),
+		[]byte(testPrivateKey), options)
+	require.Nil(t, err)
+	iat, err := TokenTimeClaim(tkn, "iat")
+	require.Nil(t, err)
+	exp, err := TokenTimeClaim(tkn, "exp")
+	require.Nil(t, err)
+	require.Equal(t, options.TTL, exp.Sub(iat))
+	nbf, err := TokenTimeClaim(tkn, "nbf")
+	require.Nil(t, err)
+	require.True(t, nbf.IsZero())
+	_, err = TokenTimeClaim(tkn, middleware.ClaimUserId)
+	require.NotNil(t, err)
+}
+
+func TestClientCredentials(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.SetBasicAuth("my%20client", "s3cret")
+	id, secret := ClientCredentials(r)
+	require.Equal(t, "my client", id)
+	require.Equal(t, "s3cret", secret)
+
+	form := url.Values{"client_id": {"abc"}, "client_secret": {"def"}}
+	r = httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	id, secret = ClientCredentials(r)
+	require.Equal(t, "abc", id)
+	require.Equal(t, "def", secret)
+}
+
+func TestDeviceFromRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "simpleauth-test")
+	expected := models.Device{
+		UserAgent: "simpleauth-test",
+		IpAddress: "192.0.2.1",
+	}
+	require.Equal(t, expected, DeviceFromRequest(r))
+}
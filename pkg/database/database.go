@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	cdb "github.com/crossedbot/common/golang/db"
 	"github.com/google/uuid"
@@ -23,21 +24,66 @@ const (
 
 var (
 	// Errors
-	ErrUserExists = errors.New("The username, email or phone number already exists")
+	ErrUserExists       = errors.New("The username, email or phone number already exists")
+	ErrRefreshTokenUsed = errors.New("The refresh token has already been used or revoked")
+	ErrCodeUsed         = errors.New("The authorization code has already been used")
 )
 
 // Database represents an interface to the authentication database and the
 // management of users.
 type Database interface {
+	// DeleteSession removes the session for the given session ID.
+	DeleteSession(sessionId string) error
+
+	// DeleteSessions removes every session of the given user ID.
+	DeleteSessions(userId string) error
+
+	// GetSession returns the session for the given session ID.
+	GetSession(sessionId string) (models.Session, error)
+
+	// GetSessions returns the sessions of the given user ID, ordered from
+	// most to least recently used.
+	GetSessions(userId string) ([]models.Session, error)
+
 	// GetUser returns the user for the given user ID. This ID is not to be
 	// confused with the records ID in the table but the generated value for the
 	// user_id field.
 	GetUser(id string) (models.User, error)
 
+	// GetRefreshToken returns the refresh token record for the given token
+	// ID.
+	GetRefreshToken(tokenId string) (models.RefreshToken, error)
+
 	// GetUserByName returns the user for the given name. This name can be
 	// either the username or email address of the user as an identifier.
 	GetUserByName(name string) (models.User, error)
 
+	// IsTokenRevoked returns true if the token for the given token ID has
+	// been revoked, or if the tokens of the given user ID were revoked after
+	// the given time of issue.
+	IsTokenRevoked(tokenId, userId string, issuedAt time.Time) (bool, error)
+
+	// RevokeRefreshTokens revokes every refresh token belonging to the given
+	// user ID.
+	RevokeRefreshTokens(userId string) error
+
+	// RevokeToken adds the given token revocation to the database.
+	RevokeToken(tkn models.RevokedToken) error
+
+	// RevokeTokenFamily revokes every refresh token belonging to the given
+	// token family.
+	RevokeTokenFamily(familyId string) error
+
+	// SaveAuthorizationCode adds the given authorization code to the
+	// database.
+	SaveAuthorizationCode(code models.AuthorizationCode) error
+
+	// SaveRefreshToken adds the given refresh token record to the database.
+	SaveRefreshToken(tkn models.RefreshToken) error
+
+	// SaveSession adds the given session to the database.
+	SaveSession(session models.Session) error
+
 	// SaveUser adds the given user to the database. It should fill in the
 	// remaining fields like the record and user ID.
 	SaveUser(user models.User) (models.User, error)
@@ -46,13 +92,23 @@ type Database interface {
 	// public key.
 	SetPublicKey(userId, pubKey string) error
 
+	// TouchSession updates the last use of the session for the given session
+	// ID, along with the IP address it was used from.
+	TouchSession(sessionId, ipAddress string) error
+
 	// UpdateTotp updates the TOTP state of the user for the given user ID.
 	// Either enabling TOTP and/or setting its value itself.
 	UpdateTotp(enable bool, totp, userId string) error
 
-	// UpdateTokens updates the user's access and refresh token for the given
-	// user ID.
-	UpdateTokens(token, refreshToken, userId string) error
+	// UseAuthorizationCode marks the authorization code for the given code
+	// hash as used and returns it. If the code was already used, ErrCodeUsed
+	// is returned.
+	UseAuthorizationCode(codeHash string) (models.AuthorizationCode, error)
+
+	// UseRefreshToken marks the refresh token for the given token ID as
+	// used. If the token was already used or revoked, ErrRefreshTokenUsed is
+	// returned.
+	UseRefreshToken(tokenId string) error
 }
 
 // database represents an authentication database.
@@ -80,6 +136,36 @@ func New(ctx context.Context, dialect, path string) (Database, error) {
 	return db, nil
 }
 
+func (db *database) DeleteSession(sessionId string) error {
+	return db.Db.DeleteTx(&models.Session{}, "session_id = ?", sessionId)
+}
+
+func (db *database) DeleteSessions(userId string) error {
+	return db.Db.DeleteTx(&models.Session{}, "user_id = ?", userId)
+}
+
+func (db *database) GetSession(sessionId string) (models.Session, error) {
+	var session models.Session
+	err := db.Db.Read(&session, "session_id = ?", sessionId)
+	if err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+func (db *database) GetSessions(userId string) ([]models.Session, error) {
+	var sessions []models.Session
+	err := db.Db.Tx(func(tx *gorm.DB) error {
+		return tx.Where("user_id = ?", userId).
+			Order("last_used_at DESC").
+			Find(&sessions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
 func (db *database) GetUser(id string) (models.User, error) {
 	var user models.User
 	err := db.Db.Read(&user, "user_id = ?", id)
@@ -89,6 +175,15 @@ func (db *database) GetUser(id string) (models.User, error) {
 	return user, nil
 }
 
+func (db *database) GetRefreshToken(tokenId string) (models.RefreshToken, error) {
+	var tkn models.RefreshToken
+	err := db.Db.Read(&tkn, "token_id = ?", tokenId)
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	return tkn, nil
+}
+
 func (db *database) GetUserByName(name string) (models.User, error) {
 	var user models.User
 	err := db.Db.Read(&user, "username = ? OR email = ?", name, name)
@@ -98,6 +193,47 @@ func (db *database) GetUserByName(name string) (models.User, error) {
 	return user, nil
 }
 
+func (db *database) IsTokenRevoked(tokenId, userId string, issuedAt time.Time) (bool, error) {
+	var count int64
+	err := db.Db.Tx(func(tx *gorm.DB) error {
+		return tx.Model(&models.RevokedToken{}).
+			Where("(token_id <> '' AND token_id = ?) OR "+
+				"(token_id = '' AND user_id = ? AND created_at > ?)",
+				tokenId, userId, issuedAt).
+			Count(&count).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (db *database) RevokeRefreshTokens(userId string) error {
+	value := models.RefreshToken{Revoked: true}
+	return db.Db.UpdateTx(value, "user_id = ?", userId)
+}
+
+func (db *database) RevokeToken(tkn models.RevokedToken) error {
+	return db.Db.SaveTx(&tkn)
+}
+
+func (db *database) RevokeTokenFamily(familyId string) error {
+	value := models.RefreshToken{Revoked: true}
+	return db.Db.UpdateTx(value, "family_id = ?", familyId)
+}
+
+func (db *database) SaveAuthorizationCode(code models.AuthorizationCode) error {
+	return db.Db.SaveTx(&code)
+}
+
+func (db *database) SaveRefreshToken(tkn models.RefreshToken) error {
+	return db.Db.SaveTx(&tkn)
+}
+
+func (db *database) SaveSession(session models.Session) error {
+	return db.Db.SaveTx(&session)
+}
+
 func (db *database) SaveUser(user models.User) (models.User, error) {
 	// Check if the user's username, email, or phone number already exists, if
 	// they do the user is considered to exist and an error is returned.
@@ -134,6 +270,14 @@ func (db *database) SetPublicKey(userId, pubKey string) error {
 	return db.Db.UpdateTx(value, "user_id = ?", userId)
 }
 
+func (db *database) TouchSession(sessionId, ipAddress string) error {
+	value := models.Session{
+		IpAddress:  ipAddress,
+		LastUsedAt: time.Now(),
+	}
+	return db.Db.UpdateTx(value, "session_id = ?", sessionId)
+}
+
 func (db *database) UpdateTotp(enable bool, totp, userId string) error {
 	value := models.User{
 		TotpEnabled: enable,
@@ -142,10 +286,45 @@ func (db *database) UpdateTotp(enable bool, totp, userId string) error {
 	return db.Db.UpdateTx(value, "user_id = ?", userId)
 }
 
-func (db *database) UpdateTokens(token, refreshToken, userId string) error {
-	value := models.User{
-		Token:        token,
-		RefreshToken: refreshToken,
+func (db *database) UseAuthorizationCode(codeHash string) (models.AuthorizationCode, error) {
+	var code models.AuthorizationCode
+	err := db.Db.Tx(func(tx *gorm.DB) error {
+		result := tx.Model(&models.AuthorizationCode{}).
+			Where("code_hash = ? AND used = ?", codeHash, false).
+			Update("used", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if err := tx.Where("code_hash = ?", codeHash).
+			First(&code).Error; err != nil {
+			return err
+		}
+		if result.RowsAffected == 0 {
+			return ErrCodeUsed
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AuthorizationCode{}, err
 	}
-	return db.Db.UpdateTx(value, "user_id = ?", userId)
+	return code, nil
+}
+
+func (db *database) UseRefreshToken(tokenId string) error {
+	return db.Db.Tx(func(tx *gorm.DB) error {
+		// Only an unused and unrevoked token can be marked used; this
+		// makes the check-and-set a single statement, so concurrent
+		// refreshes using the same token can't both succeed.
+		result := tx.Model(&models.RefreshToken{}).
+			Where("token_id = ? AND used = ? AND revoked = ?",
+				tokenId, false, false).
+			Update("used", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenUsed
+		}
+		return nil
+	})
 }
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"crypto/subtle"
+)
+
+// Client models an OAuth client registered with the authentication service;
+// E.g. a resource server introspecting tokens, an app logging in users, or a
+// service account acting on its own behalf.
+type Client struct {
+	ClientId     string   `toml:"client_id" json:"client_id"`
+	ClientSecret string   `toml:"client_secret" json:"-"`
+	PublicKey    string   `toml:"public_key" json:"-"` // PEM key for private_key_jwt
+	Name         string   `toml:"name" json:"name"`
+	RedirectUris []string `toml:"redirect_uris" json:"redirect_uris"`
+	GrantTypes   []string `toml:"grant_types" json:"grant_types"`
+	Grants       []string `toml:"grants" json:"grants"` // Grants of service tokens
+}
+
+// DefaultClientGrantTypes are the OAuth grant types allowed to clients that
+// don't configure their own.
+var DefaultClientGrantTypes = []string{
+	GrantTypeAuthorizationCode,
+	GrantTypeRefreshToken,
+}
+
+// AllowsGrantType returns true if the client may use the given OAuth grant
+// type. Clients that don't configure grant types are allowed the
+// DefaultClientGrantTypes.
+func (c Client) AllowsGrantType(grantType string) bool {
+	allowed := c.GrantTypes
+	if len(allowed) == 0 {
+		allowed = DefaultClientGrantTypes
+	}
+	for _, gt := range allowed {
+		if gt == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// Public returns true if the client has neither a secret nor a public key to
+// authenticate with; E.g. a browser or mobile app that can't keep a secret.
+func (c Client) Public() bool {
+	return c.ClientSecret == "" && c.PublicKey == ""
+}
+
+// ValidRedirectUri returns true if the given URI is one of the client's
+// registered redirect URIs. URIs must match exactly.
+func (c Client) ValidRedirectUri(uri string) bool {
+	for _, registered := range c.RedirectUris {
+		if uri != "" && uri == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidSecret returns true if the given secret matches the client's secret. A
+// client without a secret never matches.
+func (c Client) ValidSecret(secret string) bool {
+	if c.ClientSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare(
+		[]byte(c.ClientSecret),
+		[]byte(secret),
+	) == 1
+}
+
+// Introspection represents the state of a token as described by RFC 7662. An
+// inactive token only reports that it is inactive.
+type Introspection struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope,omitempty"`
+	Grant    string `json:"grant,omitempty"`
+	Sub      string `json:"sub,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+	Jti      string `json:"jti,omitempty"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	UserType string `json:"user_type,omitempty"`
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientValidSecret(t *testing.T) {
+	tests := []struct {
+		Client   Client
+		Secret   string
+		Expected bool
+	}{
+		{Client{ClientId: "abc", ClientSecret: "s3cret"}, "s3cret", true},
+		{Client{ClientId: "abc", ClientSecret: "s3cret"}, "S3cret", false},
+		{Client{ClientId: "abc", ClientSecret: "s3cret"}, "", false},
+		{Client{ClientId: "abc"}, "", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Expected, test.Client.ValidSecret(test.Secret))
+	}
+}
+
+func TestClientAllowsGrantType(t *testing.T) {
+	client := Client{ClientId: "abc"}
+	require.True(t, client.AllowsGrantType(GrantTypeAuthorizationCode))
+	require.True(t, client.AllowsGrantType(GrantTypeRefreshToken))
+	require.False(t, client.AllowsGrantType(GrantTypeClientCredentials))
+	client.GrantTypes = []string{GrantTypeClientCredentials}
+	require.False(t, client.AllowsGrantType(GrantTypeAuthorizationCode))
+	require.True(t, client.AllowsGrantType(GrantTypeClientCredentials))
+}
+
+func TestClientPublic(t *testing.T) {
+	require.True(t, Client{ClientId: "abc"}.Public())
+	require.False(t, Client{ClientId: "abc", ClientSecret: "s3cret"}.Public())
+	require.False(t, Client{ClientId: "abc", PublicKey: "key"}.Public())
+}
+
+func TestClientValidRedirectUri(t *testing.T) {
+	client := Client{
+		ClientId: "abc",
+		RedirectUris: []string{
+			"https://app.example.com/callback",
+			"com.example.app:/callback",
+		},
+	}
+	tests := []struct {
+		Uri      string
+		Expected bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"com.example.app:/callback", true},
+		{"https://app.example.com/callback/", false},
+		{"https://app.example.com/callback?next=evil", false},
+		{"https://evil.example.com/callback", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.Expected, client.ValidRedirectUri(test.Uri))
+	}
+}
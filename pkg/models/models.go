@@ -36,24 +36,22 @@ var (
 
 // User models a user in the authentication service.
 type User struct {
-	ID           uint           `gorm:"primarykey" json:"-"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
-	FirstName    string         `json:"first_name"`
-	LastName     string         `json:"last_name"`
-	Password     string         `json:"password"`
-	Email        string         `json:"email"`
-	Username     string         `json:"username"`
-	Phone        string         `json:"phone"`
-	UserType     string         `json:"user_type"`
-	UserId       string         `json:"user_id"`
-	Token        string         `json:"-"`
-	RefreshToken string         `json:"-"`
-	TotpEnabled  bool           `json:"totp_enabled"`
-	Totp         string         `json:"-"`
-	Options      Options        `gorm:"serializer:json" json:"options"`
-	PublicKey    string         `json:"public_key"`
+	ID          uint           `gorm:"primarykey" json:"-"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	FirstName   string         `json:"first_name"`
+	LastName    string         `json:"last_name"`
+	Password    string         `json:"password"`
+	Email       string         `json:"email"`
+	Username    string         `json:"username"`
+	Phone       string         `json:"phone"`
+	UserType    string         `json:"user_type"`
+	UserId      string         `json:"user_id"`
+	TotpEnabled bool           `json:"totp_enabled"`
+	Totp        string         `json:"-"`
+	Options     Options        `gorm:"serializer:json" json:"options"`
+	PublicKey   string         `json:"public_key"`
 }
 
 // Valid returns nil when the user is valid, otherwise an error is returned.
@@ -122,6 +120,8 @@ type Users struct {
 type Login struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
+	ClientId string `json:"client_id"` // OAuth client logging in the user
+	Nonce    string `json:"nonce"`     // OpenID Connect nonce of the client
 }
 
 // Totp represents a timed-based OTP.
@@ -131,9 +131,76 @@ type Totp struct {
 	Qr      []byte `json:"qr"`
 }
 
+// Device represents the device a user is authenticating from.
+type Device struct {
+	UserAgent string `json:"user_agent"`
+	IpAddress string `json:"ip_address"`
+}
+
+// Session models an authenticated session of a user on a device. A session
+// shares its ID with the refresh token family started by its login, and lasts
+// until it is idle for longer than its idle timeout or it expires.
+type Session struct {
+	ID          uint      `gorm:"primarykey" json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"-"`
+	SessionId   string    `gorm:"uniqueIndex" json:"session_id"`
+	UserId      string    `gorm:"index" json:"-"`
+	UserAgent   string    `json:"user_agent"`
+	IpAddress   string    `json:"ip_address"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	IdleTimeout int       `json:"idle_timeout"` // in seconds
+	ExpiresAt   time.Time `json:"expires_at"`
+	ClientId    string    `json:"client_id"`
+	Nonce       string    `json:"-"`
+	Current     bool      `gorm:"-" json:"current"`
+}
+
+// Active returns true if the session has neither expired, nor been idle for
+// longer than its idle timeout at the given time.
+func (s Session) Active(t time.Time) bool {
+	if !s.ExpiresAt.IsZero() && !t.Before(s.ExpiresAt) {
+		return false
+	}
+	if s.IdleTimeout > 0 {
+		idle := time.Duration(s.IdleTimeout) * time.Second
+		if !t.Before(s.LastUsedAt.Add(idle)) {
+			return false
+		}
+	}
+	return true
+}
+
+// RefreshToken models an issued refresh token. Each refresh token may only be
+// used once and belongs to a token family; a family is started by a login and
+// carried on by every refresh that follows it.
+type RefreshToken struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	TokenId   string    `gorm:"uniqueIndex" json:"token_id"`
+	FamilyId  string    `gorm:"index" json:"family_id"`
+	UserId    string    `gorm:"index" json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// RevokedToken models the revocation of an access or refresh token. A
+// revocation without a token ID applies to every token issued to the user
+// before the revocation was created.
+type RevokedToken struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	TokenId   string    `gorm:"index" json:"token_id"`
+	UserId    string    `gorm:"index" json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // AccessToken represents an access and refresh tokens.
 type AccessToken struct {
 	Token        string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
+	IdToken      string `json:"id_token,omitempty"`
 	OtpRequired  bool   `json:"otp_required"`
 }
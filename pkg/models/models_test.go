@@ -2,6 +2,7 @@ package models
 
 import (
 	"testing"
+	"time"
 
 	"github.com/crossedbot/common/golang/crypto"
 	"github.com/stretchr/testify/require"
@@ -231,3 +232,21 @@ func TestUserValid(t *testing.T) {
 	err = user.Valid()
 	require.NotNil(t, err)
 }
+
+func TestSessionActive(t *testing.T) {
+	now := time.Now()
+	session := Session{
+		LastUsedAt:  now,
+		IdleTimeout: 60,
+		ExpiresAt:   now.Add(1 * time.Hour),
+	}
+	require.True(t, session.Active(now))
+	// idle for longer than the idle timeout
+	require.False(t, session.Active(now.Add(1*time.Minute)))
+	// used recently but past its expiration
+	session.LastUsedAt = now.Add(1 * time.Hour)
+	require.False(t, session.Active(now.Add(1*time.Hour)))
+	// no idle timeout or expiration
+	session = Session{LastUsedAt: now}
+	require.True(t, session.Active(now.Add(24*time.Hour)))
+}
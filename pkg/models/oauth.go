@@ -0,0 +1,134 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// OAuth grant types
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+
+	// OAuth client assertion types
+	ClientAssertionTypeJwtBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// OAuth response types
+	ResponseTypeCode = "code"
+
+	// PKCE code challenge methods
+	CodeChallengeMethodS256 = "S256"
+
+	// OAuth error codes
+	OAuthErrorInvalidRequest          = "invalid_request"
+	OAuthErrorInvalidClient           = "invalid_client"
+	OAuthErrorInvalidGrant            = "invalid_grant"
+	OAuthErrorUnauthorizedClient      = "unauthorized_client"
+	OAuthErrorUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthErrorUnsupportedResponseType = "unsupported_response_type"
+	OAuthErrorInvalidScope            = "invalid_scope"
+	OAuthErrorAccessDenied            = "access_denied"
+	OAuthErrorServerError             = "server_error"
+)
+
+// OAuthError represents an OAuth 2.0 error response, as described by RFC 6749.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error returns the string representation of the OAuth error.
+func (e OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// AuthorizationRequest represents an OAuth 2.0 authorization request for an
+// authorization code.
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectUri         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// NewAuthorizationRequest returns the authorization request for the given
+// query or form values.
+func NewAuthorizationRequest(v url.Values) AuthorizationRequest {
+	return AuthorizationRequest{
+		ResponseType:        v.Get("response_type"),
+		ClientId:            v.Get("client_id"),
+		RedirectUri:         v.Get("redirect_uri"),
+		Scope:               v.Get("scope"),
+		State:               v.Get("state"),
+		Nonce:               v.Get("nonce"),
+		CodeChallenge:       v.Get("code_challenge"),
+		CodeChallengeMethod: v.Get("code_challenge_method"),
+	}
+}
+
+// AuthorizationCode models an issued authorization code. Only the hash of the
+// code is stored; the code itself is handed to the client.
+type AuthorizationCode struct {
+	ID            uint      `gorm:"primarykey" json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	CodeHash      string    `gorm:"uniqueIndex" json:"-"`
+	ClientId      string    `json:"client_id"`
+	UserId        string    `gorm:"index" json:"user_id"`
+	RedirectUri   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	Nonce         string    `json:"-"`
+	CodeChallenge string    `json:"-"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Used          bool      `json:"used"`
+}
+
+// TokenRequest represents an OAuth 2.0 token request.
+type TokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"-"`
+	Code         string `json:"code"`
+	RedirectUri  string `json:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+
+	ClientAssertionType string `json:"client_assertion_type"`
+	ClientAssertion     string `json:"-"`
+}
+
+// NewTokenRequest returns the token request for the given form values. The
+// client's ID and secret are expected to be set separately, whereas a client
+// assertion is part of the form.
+func NewTokenRequest(v url.Values) TokenRequest {
+	return TokenRequest{
+		GrantType:           v.Get("grant_type"),
+		Code:                v.Get("code"),
+		RedirectUri:         v.Get("redirect_uri"),
+		CodeVerifier:        v.Get("code_verifier"),
+		RefreshToken:        v.Get("refresh_token"),
+		Scope:               v.Get("scope"),
+		ClientAssertionType: v.Get("client_assertion_type"),
+		ClientAssertion:     v.Get("client_assertion"),
+	}
+}
+
+// TokenResponse represents an OAuth 2.0 token response.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
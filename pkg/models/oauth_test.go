@@ -0,0 +1,73 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthErrorError(t *testing.T) {
+	err := OAuthError{Code: OAuthErrorInvalidGrant}
+	require.Equal(t, "invalid_grant", err.Error())
+	err.Description = "code expired"
+	require.Equal(t, "invalid_grant: code expired", err.Error())
+	var target OAuthError
+	require.True(t, errors.As(error(err), &target))
+}
+
+func TestNewAuthorizationRequest(t *testing.T) {
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"myclient"},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"state":                 {"af0ifjsldkj"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+	expected := AuthorizationRequest{
+		ResponseType:        ResponseTypeCode,
+		ClientId:            "myclient",
+		RedirectUri:         "https://app.example.com/callback",
+		Scope:               "openid",
+		State:               "af0ifjsldkj",
+		Nonce:               "n-0S6_WzA2Mj",
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: CodeChallengeMethodS256,
+	}
+	require.Equal(t, expected, NewAuthorizationRequest(v))
+}
+
+func TestNewTokenRequest(t *testing.T) {
+	v := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"SplxlOBeZQQYbYS6WxSbIA"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"},
+		"client_id":     {"myclient"},
+	}
+	expected := TokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		Code:         "SplxlOBeZQQYbYS6WxSbIA",
+		RedirectUri:  "https://app.example.com/callback",
+		CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+	}
+	require.Equal(t, expected, NewTokenRequest(v))
+
+	v = url.Values{
+		"grant_type":            {"client_credentials"},
+		"scope":                 {"this that"},
+		"client_assertion_type": {ClientAssertionTypeJwtBearer},
+		"client_assertion":      {"eyJhbGciOiJSUzI1NiJ9.e30.c2ln"},
+	}
+	expected = TokenRequest{
+		GrantType:           GrantTypeClientCredentials,
+		Scope:               "this that",
+		ClientAssertionType: ClientAssertionTypeJwtBearer,
+		ClientAssertion:     "eyJhbGciOiJSUzI1NiJ9.e30.c2ln",
+	}
+	require.Equal(t, expected, NewTokenRequest(v))
+}
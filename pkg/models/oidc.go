@@ -0,0 +1,57 @@
+package models
+
+import (
+	"strings"
+)
+
+// OpenIdConfiguration represents the OpenID Connect discovery document of the
+// authentication service.
+type OpenIdConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// UserInfo represents the standard OpenID Connect claims of a user.
+type UserInfo struct {
+	Sub               string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	PhoneNumber       string `json:"phone_number,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+	UserType          string `json:"user_type,omitempty"`
+}
+
+// NewUserInfo returns the OpenID Connect claims of the given user.
+func NewUserInfo(u User) UserInfo {
+	info := UserInfo{
+		Sub: u.UserId,
+		Name: strings.TrimSpace(
+			strings.Join([]string{u.FirstName, u.LastName}, " "),
+		),
+		GivenName:         u.FirstName,
+		FamilyName:        u.LastName,
+		PreferredUsername: u.Username,
+		Email:             u.Email,
+		PhoneNumber:       u.Phone,
+		UserType:          u.UserType,
+	}
+	if !u.UpdatedAt.IsZero() {
+		info.UpdatedAt = u.UpdatedAt.Unix()
+	}
+	return info
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUserInfo(t *testing.T) {
+	updatedAt := time.Unix(1667000000, 0)
+	user := User{
+		UpdatedAt: updatedAt,
+		FirstName: "John",
+		LastName:  "Doe",
+		Email:     "jdoe@example.com",
+		Username:  "jdoe",
+		Phone:     "555-555-5555",
+		UserType:  BaseUserType.String(),
+		UserId:    "abc123",
+	}
+	expected := UserInfo{
+		Sub:               "abc123",
+		Name:              "John Doe",
+		GivenName:         "John",
+		FamilyName:        "Doe",
+		PreferredUsername: "jdoe",
+		Email:             "jdoe@example.com",
+		PhoneNumber:       "555-555-5555",
+		UpdatedAt:         updatedAt.Unix(),
+		UserType:          "USER",
+	}
+	require.Equal(t, expected, NewUserInfo(user))
+
+	user = User{UserId: "abc123", LastName: "Doe"}
+	expected = UserInfo{Sub: "abc123", Name: "Doe", FamilyName: "Doe"}
+	require.Equal(t, expected, NewUserInfo(user))
+}
@@ -62,6 +62,8 @@ type SignedPublicKey struct {
 	User      string `json:"user"`
 	PublicKey string `json:"public_key"`
 	Signature string `json:"signature"`
+	ClientId  string `json:"client_id"` // OAuth client logging in the user
+	Nonce     string `json:"nonce"`     // OpenID Connect nonce of the client
 }
 
 // SigningAlgorithm returns the signing algorithm of the signed public key.